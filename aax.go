@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+////////////////////////////////////////////////////////////////////////
+//
+//   __ _  __ ___  __
+//  / _` |/ _` \ \/ /
+// | (_| | (_| |>  <
+//  \__,_|\__,_/_/\_\
+////////////////////////////////////////////////////////////////////////
+
+// An .aax file is an ordinary MP4 whose audio samples have been
+// encrypted with AES-128-CBC and whose audio track's sample entry is
+// called "aavd" rather than "mp4a".  The key is stored, itself
+// encrypted, in an "adrm" box within that sample entry along with a
+// checksum which lets us tell whether a set of activation bytes is the
+// right one.  This is a port of what ffmpeg's mov demuxer does.
+
+// Used along with the activation bytes to derive the key which
+// decrypts the key which decrypts the file.
+var aaxFixedKey, _ = hex.DecodeString("77214d4b196a87cd520045fd20a51d67")
+
+// Locations of the interesting parts of an .aax file.  Offsets into
+// Moov are relative to MoovOffset in the file, and Stbl holds the
+// bounds of the contents of the encrypted audio's sample table.
+type aaxFile struct {
+	Size       int64
+	MoovOffset int64
+	Moov       []byte
+	FtypOffset int64
+	Ftyp       []byte
+	Adrm       []byte // Contents of the adrm box, minus its header
+	AdrmType   int    // Offset of the adrm box's type in Moov
+	AavdType   int    // Offset of the aavd sample entry's type in Moov
+	Stbl       []int
+	Samples    []aaxChunk
+}
+
+// A run of contiguous encrypted samples in the file.
+type aaxChunk struct {
+	Offset int64
+	Sizes  []uint32
+}
+
+// Read the box header at the start of BUF, returning the box's type,
+// its total size, and the size of the header.
+func readBox(buf []byte) (string, int, int, error) {
+	if len(buf) < 8 {
+		return "", 0, 0, errors.New("truncated box header")
+	}
+	size := int(binary.BigEndian.Uint32(buf))
+	typ := string(buf[4:8])
+	hdr := 8
+	if size == 1 {
+		if len(buf) < 16 {
+			return "", 0, 0, errors.New("truncated box header")
+		}
+		size = int(binary.BigEndian.Uint64(buf[8:]))
+		hdr = 16
+	} else if size == 0 {
+		size = len(buf)
+	}
+	if size < hdr || size > len(buf) {
+		return "", 0, 0, errors.New("bad size for box " + typ)
+	}
+	return typ, size, hdr, nil
+}
+
+// Parse the .aax file F, working out where the encrypted samples are
+// as well as everything readAAXHeader() does.
+func parseAAX(f *os.File) (*aaxFile, error) {
+	aax, err := readAAXHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	if err = aax.readSampleTable(aax.Stbl[0], aax.Stbl[1]); err != nil {
+		return nil, err
+	}
+	for _, chunk := range aax.Samples {
+		end := chunk.Offset
+		for _, s := range chunk.Sizes {
+			end += int64(s)
+		}
+		if chunk.Offset < 0 || end > aax.Size {
+			return nil, errors.New("sample table points past the " +
+				"end of the file")
+		}
+	}
+	return aax, nil
+}
+
+// Parse the top-level boxes of the .aax file F, pulling the ftyp and
+// moov boxes into memory and finding the adrm box, which is all that's
+// needed to check activation bytes against the file.  The sample table
+// is left alone, so a file whose samples are damaged can still be
+// matched to its account.
+func readAAXHeader(f *os.File) (*aaxFile, error) {
+	aax := &aaxFile{AdrmType: -1, AavdType: -1}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	aax.Size = fi.Size()
+	var hdr [16]byte
+	for off := int64(0); off < fi.Size(); {
+		n, err := f.ReadAt(hdr[:], off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:]))
+		typ := string(hdr[4:8])
+		if n >= 16 && size == 1 {
+			size = int64(binary.BigEndian.Uint64(hdr[8:]))
+		} else if size == 0 {
+			size = fi.Size() - off
+		}
+		if size < 8 || size > fi.Size()-off {
+			return nil, errors.New("bad size for box " + typ)
+		}
+		if typ == "moov" || typ == "ftyp" {
+			buf := make([]byte, size)
+			if _, err := f.ReadAt(buf, off); err != nil {
+				return nil, err
+			}
+			if typ == "moov" {
+				aax.MoovOffset, aax.Moov = off, buf
+			} else {
+				aax.FtypOffset, aax.Ftyp = off, buf
+			}
+		}
+		off += size
+	}
+	if aax.Moov == nil {
+		return nil, errors.New("no moov box, is this an mp4 file?")
+	}
+	if err = aax.walk(0, len(aax.Moov)); err != nil {
+		return nil, err
+	}
+	if aax.Adrm == nil {
+		return nil, errors.New("no adrm box, is this an aax file?")
+	}
+	return aax, nil
+}
+
+// Recursively search the boxes in Moov[START:END] for the trak
+// containing the encrypted audio.
+func (aax *aaxFile) walk(start, end int) error {
+	for off := start; off < end; {
+		typ, size, hdr, err := readBox(aax.Moov[off:end])
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case "moov", "mdia", "minf":
+			err = aax.walk(off+hdr, off+size)
+		case "trak":
+			err = aax.walkTrak(off+hdr, off+size)
+		}
+		if err != nil {
+			return err
+		}
+		off += size
+	}
+	return nil
+}
+
+// Look at the sample table of the trak in Moov[START:END], and if it
+// holds encrypted audio, record where it and its adrm box are.
+func (aax *aaxFile) walkTrak(start, end int) error {
+	stbl := aax.find(start, end, "mdia", "minf", "stbl")
+	if stbl == nil {
+		return nil
+	}
+	stsd := aax.find(stbl[0], stbl[1], "stsd")
+	// Skip the full box header and the entry count
+	if stsd == nil || stsd[0]+8 > stsd[1] {
+		return nil
+	}
+	typ, size, hdr, err := readBox(aax.Moov[stsd[0]+8 : stsd[1]])
+	if err != nil || typ != "aavd" {
+		return err
+	}
+	entry := stsd[0] + 8
+	aax.AavdType = entry + 4
+	// The sample entry's children follow 28 bytes of audio fields
+	adrm := aax.find(entry+hdr+28, entry+size, "adrm")
+	if adrm == nil {
+		return errors.New("aavd sample entry without an adrm box")
+	}
+	aax.AdrmType = adrm[0] - 4
+	aax.Adrm = aax.Moov[adrm[0]:adrm[1]]
+	aax.Stbl = stbl
+	return nil
+}
+
+// Return the bounds of the contents of the box reached by following
+// PATH from Moov[START:END], or nil if there isn't one.
+func (aax *aaxFile) find(start, end int, path ...string) []int {
+	for off := start; off < end; {
+		typ, size, hdr, err := readBox(aax.Moov[off:end])
+		if err != nil {
+			return nil
+		}
+		if typ == path[0] {
+			if len(path) == 1 {
+				return []int{off + hdr, off + size}
+			}
+			return aax.find(off+hdr, off+size, path[1:]...)
+		}
+		off += size
+	}
+	return nil
+}
+
+// Return the contents of the sample table box in Moov[BOX[0]:BOX[1]]
+// along with its number of entries, which is the 32-bit field at
+// offset HEAD, just before the entries of WIDTH bytes each.  Tables too
+// short for the entries they claim to have are refused.
+func (aax *aaxFile) table(box []int, name string, head, width int) ([]byte, int, error) {
+	b := aax.Moov[box[0]:box[1]]
+	if len(b) < 4+head {
+		return nil, 0, errors.New("truncated " + name + " box")
+	}
+	n := int(binary.BigEndian.Uint32(b[head:]))
+	if width > 0 && n > (len(b)-4-head)/width {
+		return nil, 0, errors.New("truncated " + name + " box")
+	}
+	return b, n, nil
+}
+
+// Work out the offset and size of every sample from the sample table
+// in Moov[START:END].
+func (aax *aaxFile) readSampleTable(start, end int) error {
+	be := binary.BigEndian
+	stsz := aax.find(start, end, "stsz")
+	stsc := aax.find(start, end, "stsc")
+	if stsz == nil || stsc == nil {
+		return errors.New("incomplete sample table")
+	}
+	var chunks []int64
+	if stco := aax.find(start, end, "stco"); stco != nil {
+		b, n, err := aax.table(stco, "stco", 4, 4)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			chunks = append(chunks, int64(be.Uint32(b[8+4*i:])))
+		}
+	} else if co64 := aax.find(start, end, "co64"); co64 != nil {
+		b, n, err := aax.table(co64, "co64", 4, 8)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			chunks = append(chunks, int64(be.Uint64(b[8+8*i:])))
+		}
+	} else {
+		return errors.New("no chunk offsets in sample table")
+	}
+
+	// Samples all have the same size unless it's 0, in which case
+	// they each have their own
+	b, nsamples, err := aax.table(stsz, "stsz", 8, 0)
+	if err != nil {
+		return err
+	}
+	fixed := be.Uint32(b[4:])
+	if fixed == 0 {
+		if b, nsamples, err = aax.table(stsz, "stsz", 8, 4); err != nil {
+			return err
+		}
+	}
+	size := func(i int) uint32 {
+		if fixed != 0 {
+			return fixed
+		}
+		return be.Uint32(b[12+4*i:])
+	}
+
+	c, nruns, err := aax.table(stsc, "stsc", 4, 12)
+	if err != nil {
+		return err
+	}
+	sample := 0
+	for r := 0; r < nruns; r++ {
+		first := int(be.Uint32(c[8+12*r:])) - 1
+		if first < 0 {
+			return errors.New("bad chunk number in stsc box")
+		}
+		per := int(be.Uint32(c[12+12*r:]))
+		last := len(chunks)
+		if r+1 < nruns {
+			last = int(be.Uint32(c[8+12*(r+1):])) - 1
+		}
+		for ch := first; ch < last && ch < len(chunks); ch++ {
+			chunk := aaxChunk{Offset: chunks[ch]}
+			for i := 0; i < per && sample < nsamples; i++ {
+				chunk.Sizes = append(chunk.Sizes, size(sample))
+				sample++
+			}
+			aax.Samples = append(aax.Samples, chunk)
+		}
+	}
+	return nil
+}
+
+// Derive the intermediate key and iv from the activation BYTES, and
+// the checksum of the two which the file stores in its adrm box.
+func aaxIntermediates(bytes []byte) ([]byte, []byte, []byte) {
+	h := sha1.New()
+	h.Write(aaxFixedKey)
+	h.Write(bytes)
+	key := h.Sum(nil)
+	h.Reset()
+	h.Write(aaxFixedKey)
+	h.Write(key)
+	h.Write(bytes)
+	iv := h.Sum(nil)
+	h.Reset()
+	h.Write(key[:16])
+	h.Write(iv[:16])
+	return key[:16], iv[:16], h.Sum(nil)
+}
+
+// The checksum stored in the file's adrm box.
+func (aax *aaxFile) checksum() ([]byte, error) {
+	if len(aax.Adrm) < 8+56+4+20 {
+		return nil, errors.New("adrm box is truncated")
+	}
+	return aax.Adrm[8+56+4 : 8+56+4+20], nil
+}
+
+// Determine whether the hex-encoded activation bytes ACTIVATION unlock
+// this file.
+func (aax *aaxFile) checkBytes(activation string) bool {
+	raw, err := hex.DecodeString(activation)
+	if err != nil || len(raw) != 4 {
+		return false
+	}
+	sum, err := aax.checksum()
+	if err != nil {
+		return false
+	}
+	_, _, calc := aaxIntermediates(raw)
+	return bytes.Equal(sum, calc)
+}
+
+// Use the hex-encoded activation bytes ACTIVATION to decrypt the key
+// and iv with which the file's samples were encrypted.
+func (aax *aaxFile) fileKey(activation string) ([]byte, []byte, error) {
+	raw, err := hex.DecodeString(activation)
+	if err != nil || len(raw) != 4 {
+		return nil, nil, errors.New("activation bytes must be 8 hex digits")
+	}
+	if !aax.checkBytes(activation) {
+		return nil, nil, errors.New("activation bytes don't match this file")
+	}
+	key, iv, _ := aaxIntermediates(raw)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	blob := make([]byte, 56)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(blob[:48],
+		aax.Adrm[8:8+48])
+	// The activation bytes are stored little-endian in the blob
+	for i := 0; i < 4; i++ {
+		if raw[i] != blob[3-i] {
+			return nil, nil, errors.New("incorrect activation bytes")
+		}
+	}
+	filekey := append([]byte(nil), blob[8:24]...)
+	h := sha1.New()
+	h.Write(blob[26:42])
+	h.Write(filekey)
+	h.Write(aaxFixedKey)
+	return filekey, h.Sum(nil)[:16], nil
+}
+
+// Decrypt the .aax file in IN into the .m4b file in OUT using the
+// activation bytes ACTIVATION.  Decryption doesn't change the size of
+// anything, so we copy the file and decrypt each sample in place,
+// then rename the encrypted sample entry and brand so that players
+// treat it as an ordinary m4b.  The fraction of chunks decrypted so
+// far is sent to PROGRESS, and we give up between chunks if CTX is
+// cancelled.
+func decryptAAX(ctx context.Context, in, out, activation string, progress chan<- float64) error {
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	aax, err := parseAAX(src)
+	if err != nil {
+		return err
+	}
+	key, iv, err := aax.fileKey(activation)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if _, err = io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	for i, chunk := range aax.Samples {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		progress <- float64(i) / float64(len(aax.Samples))
+		var total int64
+		for _, s := range chunk.Sizes {
+			total += int64(s)
+		}
+		buf := make([]byte, total)
+		if _, err = dst.ReadAt(buf, chunk.Offset); err != nil {
+			return err
+		}
+		pos := 0
+		for _, s := range chunk.Sizes {
+			// Trailing partial blocks are left unencrypted
+			n := int(s) &^ 15
+			cipher.NewCBCDecrypter(block, iv).CryptBlocks(
+				buf[pos:pos+n], buf[pos:pos+n])
+			pos += int(s)
+		}
+		if _, err = dst.WriteAt(buf, chunk.Offset); err != nil {
+			return err
+		}
+	}
+
+	copy(aax.Moov[aax.AavdType:], "mp4a")
+	copy(aax.Moov[aax.AdrmType:], "free")
+	if _, err = dst.WriteAt(aax.Moov, aax.MoovOffset); err != nil {
+		return err
+	}
+	if aax.Ftyp != nil {
+		ftyp := bytes.ReplaceAll(aax.Ftyp, []byte("aax "), []byte("M4B "))
+		if _, err = dst.WriteAt(ftyp, aax.FtypOffset); err != nil {
+			return err
+		}
+	}
+	return dst.Close()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The activation bytes our fake .aax files are encrypted with.
+const testActivation = "deadbeef"
+
+// The iv our fake .aax files' samples are encrypted with, worked out
+// independently from ffmpeg's mov demuxer as the first half of
+// sha1("fedcba9876543210" || "0123456789abcdef" || aaxFixedKey).
+const testFileIV = "06b3161b9360a029090cdf00b9ab34c1"
+
+// The samples in our fake .aax files, before encryption.  The first
+// ends in a partial block, which stays unencrypted.
+var testSamples = [][]byte{
+	[]byte("The first sample of audio, 37 bytes.."),
+	[]byte("The second sample, 32 bytes long"),
+}
+
+// Return a box of type TYP holding the concatenation of CONTENTS.
+func testBox(typ string, contents ...[]byte) []byte {
+	body := bytes.Join(contents, nil)
+	buf := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(8+len(body)))
+	copy(buf[4:], typ)
+	return append(buf, body...)
+}
+
+// Return the 32-bit big-endian integers NS.
+func testU32(ns ...int) []byte {
+	buf := make([]byte, 4*len(ns))
+	for i, n := range ns {
+		binary.BigEndian.PutUint32(buf[4*i:], uint32(n))
+	}
+	return buf
+}
+
+// Return the contents of an adrm box which stores the file key FILEKEY
+// and the material for the file iv IVPART, locked with the activation
+// bytes ACTIVATION.
+func testAdrm(activation string, filekey, ivpart []byte) []byte {
+	raw, _ := hex.DecodeString(activation)
+	key, iv, sum := aaxIntermediates(raw)
+	blob := make([]byte, 48)
+	for i := 0; i < 4; i++ {
+		blob[3-i] = raw[i]
+	}
+	copy(blob[8:24], filekey)
+	copy(blob[26:42], ivpart)
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(blob, blob)
+	adrm := make([]byte, 88)
+	copy(adrm[8:56], blob)
+	copy(adrm[68:88], sum)
+	return adrm
+}
+
+// Return a minimal .aax file holding testSamples encrypted with
+// testActivation.  MANGLE, if not nil, may change the sample size
+// table before the file is put together.
+func testAAX(mangle func(stsz []byte) []byte) []byte {
+	filekey := []byte("0123456789abcdef")
+	ivpart := []byte("fedcba9876543210")
+	fileiv, _ := hex.DecodeString(testFileIV)
+	block, _ := aes.NewCipher(filekey)
+	var mdat []byte
+	for _, s := range testSamples {
+		enc := append([]byte(nil), s...)
+		n := len(enc) &^ 15
+		cipher.NewCBCEncrypter(block, fileiv).CryptBlocks(enc[:n], enc[:n])
+		mdat = append(mdat, enc...)
+	}
+
+	ftyp := testBox("ftyp", []byte("aax "), testU32(0), []byte("aax M4A "))
+	stsz := append(testU32(0, 0, len(testSamples)),
+		testU32(len(testSamples[0]), len(testSamples[1]))...)
+	if mangle != nil {
+		stsz = mangle(stsz)
+	}
+	moov := func(offset int) []byte {
+		aavd := testBox("aavd", make([]byte, 28),
+			testBox("adrm", testAdrm(testActivation, filekey, ivpart)))
+		stbl := testBox("stbl",
+			testBox("stsd", testU32(0, 1), aavd),
+			testBox("stsz", stsz),
+			testBox("stsc", testU32(0, 1, 1, len(testSamples), 1)),
+			testBox("stco", testU32(0, 1, offset)))
+		return testBox("moov", testBox("trak", testBox("mdia",
+			testBox("minf", stbl))))
+	}
+	// The samples follow the header of the mdat box after the moov
+	offset := len(ftyp) + len(moov(0)) + 8
+	return bytes.Join([][]byte{ftyp, moov(offset), testBox("mdat", mdat)}, nil)
+}
+
+// Write CONTENTS to a file in a temporary directory and open it.
+func testFile(t *testing.T, contents []byte) *os.File {
+	path := filepath.Join(t.TempDir(), "book.aax")
+	if err := os.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestAAXIntermediates(t *testing.T) {
+	raw, _ := hex.DecodeString(testActivation)
+	key, iv, sum := aaxIntermediates(raw)
+	// Worked out independently from ffmpeg's mov demuxer
+	want := []string{
+		"6a78ececb30d7d0e7213e11b7ac03887",
+		"1391b7061f69bf4c7515fb6d793b5e59",
+		"c17c70863c0fefdef9484a1fe5aba2cd585feec0",
+	}
+	for i, got := range [][]byte{key, iv, sum} {
+		if hex.EncodeToString(got) != want[i] {
+			t.Errorf("aaxIntermediates()[%d] = %x, want %s", i, got,
+				want[i])
+		}
+	}
+}
+
+func TestFileKey(t *testing.T) {
+	aax, err := parseAAX(testFile(t, testAAX(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aax.checkBytes(testActivation) {
+		t.Errorf("checkBytes(%s) = false", testActivation)
+	}
+	if aax.checkBytes("cafebabe") {
+		t.Errorf("checkBytes(cafebabe) = true")
+	}
+	key, iv, err := aax.fileKey(testActivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "0123456789abcdef" {
+		t.Errorf("fileKey() = %q", key)
+	}
+	if hex.EncodeToString(iv) != testFileIV {
+		t.Errorf("fileKey() iv = %x, want %s", iv, testFileIV)
+	}
+	if _, _, err = aax.fileKey("cafebabe"); err == nil {
+		t.Errorf("fileKey(cafebabe) succeeded")
+	}
+}
+
+func TestDecryptAAX(t *testing.T) {
+	in := testFile(t, testAAX(nil)).Name()
+	out := filepath.Join(t.TempDir(), "book.m4b")
+	progress := make(chan float64)
+	go func() {
+		for range progress {
+		}
+	}()
+	_, err := NativeConverter{}.Convert(context.Background(), in, out,
+		testActivation, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, bytes.Join(testSamples, nil)) {
+		t.Errorf("samples weren't decrypted")
+	}
+	for _, s := range []string{"aavd", "adrm", "aax "} {
+		if bytes.Contains(raw, []byte(s)) {
+			t.Errorf("%q is still in the output", s)
+		}
+	}
+	if !bytes.Contains(raw, []byte("mp4a")) || !bytes.Contains(raw, []byte("M4B ")) {
+		t.Errorf("output isn't branded as an m4b")
+	}
+}
+
+// Broken files must be refused rather than crash the batch.
+func TestParseAAXBroken(t *testing.T) {
+	good := testAAX(nil)
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"truncated", good[:len(good)-10]},
+		{"sample count too big", testAAX(func(stsz []byte) []byte {
+			binary.BigEndian.PutUint32(stsz[8:], 1000)
+			return stsz
+		})},
+		{"stsz too short", testAAX(func(stsz []byte) []byte {
+			return stsz[:6]
+		})},
+		{"sample too big", testAAX(func(stsz []byte) []byte {
+			binary.BigEndian.PutUint32(stsz[12:], 1<<31)
+			return stsz
+		})},
+	}
+	for _, tt := range tests {
+		_, err := parseAAX(testFile(t, tt.file))
+		if err == nil {
+			t.Errorf("%s: parseAAX() succeeded", tt.name)
+		} else if strings.Contains(err.Error(), "adrm") {
+			t.Errorf("%s: parseAAX() = %s", tt.name, err)
+		}
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"golang.org/x/net/html"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -30,25 +29,44 @@ import (
 ////////////////////////////////////////////////////////////////////////
 
 // The client has a slice of these, each of which is unmartialed from
-// the list of accounts in the the .yml config file.
+// the list of accounts in the the .yml config file.  BytesCommand and
+// CookiesCommand are shell commands whose output supplies the
+// activation bytes and cookie json at runtime, for users who keep
+// their credentials in a password manager.  Quality is the preferred
+// audio quality for downloads, see qualityCodecs.  Format, Bitrate,
+// Split, MaxDuration, and MaxSize control what the downloaded books
+// are turned into, see getOutputFormat() and finishBook(), and
+// Sidecars lists the metadata files written next to them, see
+// sidecars.
 type Account struct {
-	Name   string
-	Bytes  string
-	Auth   []*http.Cookie
-	Scrape bool
-	LogBuf bytes.Buffer
+	Name           string
+	Bytes          string
+	Quality        string
+	Format         string
+	Bitrate        string
+	Split          string
+	MaxDuration    string
+	MaxSize        int
+	Sidecars       []string
+	BytesCommand   string `yaml:"bytes_command"`
+	CookiesCommand string `yaml:"cookies_command"`
+	Auth           []*http.Cookie
+	Scrape         bool
+	LogBuf         bytes.Buffer
+	failedPage     []byte
 }
 
 // Return a string representation of the account for debugging
-// purposes.
+// purposes.  Secrets are redacted so that this is safe to paste into
+// a bug report.
 func (a *Account) String() string {
 	ret := "Account:\n"
-	ret += "  Name:   " + a.Name + "\n"
-	ret += "  Bytes:  " + a.Bytes + "\n"
+	ret += "  Name:   " + a.pseudonym() + "\n"
+	ret += "  Bytes:  " + redacted + "\n"
 	ret += "  Scrape: " + strconv.FormatBool(a.Scrape) + "\n"
 	ret += "  Auth:\n"
 	for _, c := range a.Auth {
-		ret += "    " + c.Name + ": " + c.Value + "\n"
+		ret += "    " + c.Name + ": " + redacted + "\n"
 	}
 	return ret
 }
@@ -60,9 +78,11 @@ func (a *Account) PrintScraperDebuggingInfo() {
 }
 
 // Log the scraper's debugging info to the internal buffer to be
-// printed by the above method.
+// printed by the above method.  Lines are redacted before they're
+// stored since they're destined for bug reports.
 func (a *Account) Log(str string, args ...any) {
-	line := a.Name + ": " + fmt.Sprintf(str, args...) + "\n"
+	line := fmt.Sprintf(str, args...)
+	line = a.pseudonym() + ": " + a.Redact(line) + "\n"
 	a.LogBuf.WriteString(line)
 	if logFile != nil {
 		_, err := logFile.WriteString(line)
@@ -93,24 +113,109 @@ func (a *Account) ImportCookiesFromHAR(raw []byte) {
 	}
 }
 
-// Shell-out to ffmpeg in order to convert the .aax file in IN to the
-// .m4b file in OUT using this account's activation bytes.  On error,
-// return ffmpeg's output.
-func (a *Account) Convert(in, out string, client *Client) (error, []byte) {
-	tmp := client.TempDir + filepath.Base(out)
-	cmd := exec.Command("ffmpeg",
-		"-activation_bytes", a.Bytes,
-		"-i", in,
-		"-c", "copy",
-		tmp)
-	cmd.Stdout = nil
-	stderr, _ := cmd.StderrPipe()
-	err := cmd.Start()
-	slurp, _ := io.ReadAll(stderr)
+// Parse the contents of a Netscape-format cookies.txt file, as
+// exported by curl, wget, and various browser extensions, passed in
+// RAW.  Only cookies belonging to Audible or Amazon are imported.
+func (a *Account) ImportCookiesFromNetscape(raw []byte) {
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimRight(line, "\r")
+		// Curl marks HttpOnly cookies by prefixing the otherwise
+		// commented-out line
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		a.addImportedCookie(fields[0], fields[5], fields[6])
+	}
+}
+
+// Read the cookies out of the Firefox cookie database in PATH.  There
+// isn't an SQLite implementation in the standard library so we shell
+// out to sqlite3 much like we shell out to ffmpeg.  Firefox holds a
+// lock on the database while it's running, so we query a copy.  While
+// it's running, recent cookies are only in the write-ahead log next to
+// the database, so that's copied too, along with its index, and the
+// copy is opened read-write so that sqlite3 can replay it.
+func (a *Account) ImportCookiesFromFirefox(path string, client *Client) {
+	tmp := client.TempDir + "cookies.sqlite"
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		// A log left over from another import mustn't be replayed
+		os.Remove(tmp + suffix)
+		defer os.Remove(tmp + suffix)
+		raw, err := os.ReadFile(path + suffix)
+		if suffix != "" && os.IsNotExist(err) {
+			continue
+		}
+		unwrap(err)
+		unwrap(os.WriteFile(tmp+suffix, raw, 0600))
+	}
+
+	cmd := exec.Command("sqlite3", "-separator", "\t", tmp,
+		"SELECT host, name, value FROM moz_cookies")
+	out, err := cmd.Output()
+	expect(err, "Failed to read "+path+" with sqlite3")
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		a.addImportedCookie(fields[0], fields[1], fields[2])
+	}
+}
+
+// Append the cookie NAME=VALUE to the account's cookie store if
+// DOMAIN belongs to Audible or Amazon.  Amazon's cookies share their
+// names with Audible's, so the domain is kept to stop them taking the
+// place of Audible's when they're sent.
+func (a *Account) addImportedCookie(domain, name, value string) {
+	if !isAudibleDomain(domain) {
+		return
+	}
+	// See the comment in ImportCookiesFromHAR()
+	if strings.Contains(value, "\"") {
+		return
+	}
+	a.Auth = append(a.Auth, &http.Cookie{
+		Name:   name,
+		Value:  value,
+		Domain: domain,
+	})
+}
+
+// Return a cookie jar holding the account's cookies which apply to
+// URI.
+func (a *Account) cookieJar(uri string) http.CookieJar {
+	jar, _ := cookiejar.New(nil)
+	jaruri, _ := url.ParseRequestURI(uri)
+	jar.SetCookies(jaruri, a.Auth)
+	return jar
+}
+
+// Convert the .aax file in IN to the .m4b file in OUT using this
+// account's activation bytes and the client's converter, sending its
+// progress to PROGRESS.  On error, return the converter's output.  If
+// the conversion is cancelled the partial file is removed.
+func (a *Account) Convert(in, out string, client *Client, progress chan<- float64) (error, []byte) {
+	conv, err := client.converter()
 	if err != nil {
-		return err, slurp
+		close(progress)
+		return err, nil
+	}
+	// Several books with the same name may be converted at once
+	dir, err := os.MkdirTemp(client.TempDir, "convert")
+	if err != nil {
+		close(progress)
+		return err, nil
 	}
-	if err = cmd.Wait(); err != nil {
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, filepath.Base(out))
+	slurp, err := conv.Convert(client.ctx, in, tmp, a.Bytes, progress)
+	if err != nil {
 		return err, slurp
 	}
 	if err = os.Rename(tmp, out); err != nil {
@@ -121,14 +226,10 @@ func (a *Account) Convert(in, out string, client *Client) (error, []byte) {
 
 // Download a HTMl page in the user's library
 func (a *Account) getLibraryPage(page int) ([]byte, error) {
-	jar, _ := cookiejar.New(nil)
-	client := &http.Client{Jar: jar}
 	uri := "https://www.audible.com/library/titles?page=" + strconv.Itoa(page)
+	client := &http.Client{Jar: a.cookieJar(uri)}
 	req, _ := http.NewRequest("GET", uri, nil)
 
-	jaruri, _ := url.ParseRequestURI(uri)
-	jar.SetCookies(jaruri, a.Auth)
-
 	a.Log("Fetching library page %d", page)
 
 	resp, err := client.Do(req)
@@ -195,9 +296,9 @@ func (a *Account) xSingleBook(dom *html.Tokenizer, tt html.TokenType, tok html.T
 			continue
 		} else if strings.Contains(href(tok), "/series/") {
 			book.Series, book.SeriesIndex = xSeries(dom, tt, tok)
-			continue
 			a.Log("Found book series and index: %s, %d",
 				book.Series, book.SeriesIndex)
+			continue
 		} else if href(tok) == "/companion-file/"+book.Slug {
 			book.CompanionURL = "https://audible.com" + cleanstr(href(tok))
 			a.Log("Found book companion UR: %s", book.CompanionURL)
@@ -282,10 +383,10 @@ func (a *Account) ScrapeLibraryUntil(pagenum chan int, lim string) ([]Book, erro
 
 		// If we didn't extract any books from the first page then
 		// we probably won't extract any from the next, so we should
-		// just break and return an error, saving the page source in
-		// a file along with debugging information
+		// just break and return an error, keeping the page source
+		// to be saved along with debugging information
 		if len(books) == 0 {
-			ioutil.WriteFile(".audible-dl-debug.html", raw, 0644)
+			a.failedPage = []byte(a.Redact(string(raw)))
 			return nil, errors.New("Failed to extract books from HTML")
 		}
 	}
@@ -296,37 +397,89 @@ func (a *Account) ScrapeFullLibrary(pagenum chan int) ([]Book, error) {
 	return a.ScrapeLibraryUntil(pagenum, "")
 }
 
+// The error returned when Audible refuses to serve a book in any of
+// the codecs we asked for.  Status is the HTTP status of the last
+// refusal and Refused describes each of them.
+type refusedError struct {
+	Status  int
+	Refused []string
+}
+
+func (e *refusedError) Error() string {
+	return "Every codec was refused: " + strings.Join(e.Refused, ", ")
+}
+
+// The error returned when a download ends early, having received Got
+// of the Want bytes Audible promised.
+type truncatedError struct {
+	Got, Want int64
+}
+
+func (e *truncatedError) Error() string {
+	return fmt.Sprintf("Downloaded %d of %d bytes", e.Got, e.Want)
+}
+
 // Download a single .aax file from Audible's website using the URL
 // discovered by the scraper.  The file is downloaded to a .aax file
 // in the temp directory, with an intermediate .part while
 // downloading.  The path to the aax is returned in order to be passed
-// to the converter.
-func (a *Account) DownloadSingleBook(client *Client, book Book) string {
+// to the converter.  If Audible refuses a codec we fall back to the
+// next one in the account's codec ladder, recording the codec which
+// worked and why the others were refused in BOOK.  On failure the
+// .part file is removed.
+func (a *Account) DownloadSingleBook(client *Client, book *Book) (string, error) {
 	aax := client.TempDir + book.FileName + ".aax"
 	out, err := os.Create(aax + ".part")
-	unwrap(err)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
 
-	jar, _ := cookiejar.New(nil)
-	httpcl := &http.Client{Jar: jar}
-	req, _ := http.NewRequest("GET", book.DownloadURL, nil)
+	httpcl := &http.Client{Jar: a.cookieJar(book.DownloadURL)}
 
-	jaruri, _ := url.ParseRequestURI(book.DownloadURL)
-	jar.SetCookies(jaruri, a.Auth)
+	fail := func(err error) (string, error) {
+		os.Remove(aax + ".part")
+		return "", err
+	}
 
-	resp, err := httpcl.Do(req)
-	unwrap(err)
-	if resp.StatusCode != http.StatusOK {
-		log.Fatal("Request returned " + resp.Status)
+	var resp *http.Response
+	var refused refusedError
+	book.Codec = ""
+	book.Refused = nil
+	for _, codec := range client.codecLadder(a) {
+		req, _ := http.NewRequestWithContext(client.ctx, "GET",
+			codecURL(book.DownloadURL, codec), nil)
+		resp, err = httpcl.Do(req)
+		if err != nil {
+			return fail(err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			book.Codec = codec
+			break
+		}
+		resp.Body.Close()
+		a.Log("%s refused codec %s: %s", book.Slug, codec, resp.Status)
+		book.Refused = append(book.Refused, codec+": "+resp.Status)
+		refused.Status = resp.StatusCode
 	}
+	if book.Codec == "" {
+		refused.Refused = book.Refused
+		return fail(&refused)
+	}
+	defer resp.Body.Close()
 
 	nbytes, err := io.Copy(out, resp.Body)
-	unwrap(err)
+	if err != nil {
+		return fail(err)
+	}
 	if nbytes != resp.ContentLength {
-		log.Fatal("Failed to write file to disk")
+		return fail(&truncatedError{nbytes, resp.ContentLength})
 	}
 
-	unwrap(os.Rename(aax+".part", aax))
-	return aax
+	if err = os.Rename(aax+".part", aax); err != nil {
+		return fail(err)
+	}
+	return aax, nil
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -344,6 +497,18 @@ func tokBeginsBook(tt html.TokenType, tok html.Token) bool {
 		class(tok) == "adbl-library-content-row"
 }
 
+// Determine if the cookie domain D belongs to Audible or Amazon.
+// Browsers store domain cookies with a leading dot.
+func isAudibleDomain(d string) bool {
+	d = strings.TrimPrefix(strings.ToLower(d), ".")
+	for _, s := range []string{"audible.com", "amazon.com"} {
+		if d == s || strings.HasSuffix(d, "."+s) {
+			return true
+		}
+	}
+	return false
+}
+
 // Remove whitespace and other shell reserve characters from S
 func stripstr(s string) string {
 	r := regexp.MustCompile(
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+// Amazon's cookies mustn't be sent to Audible in place of Audible's own
+// ones of the same name, whichever comes first.
+func TestImportCollidingCookies(t *testing.T) {
+	amazon := ".amazon.com\tTRUE\t/\tTRUE\t0\tsession-id\tamazon\n"
+	audible := ".audible.com\tTRUE\t/\tTRUE\t0\tsession-id\taudible\n"
+	for _, raw := range []string{amazon + audible, audible + amazon} {
+		var a Account
+		a.ImportCookiesFromNetscape([]byte(raw))
+		if len(a.Auth) != 2 {
+			t.Fatalf("imported %d cookies, want 2", len(a.Auth))
+		}
+		uri := "https://www.audible.com/library/titles?page=1"
+		u, _ := url.Parse(uri)
+		cookies := a.cookieJar(uri).Cookies(u)
+		if len(cookies) != 1 || cookies[0].Value != "audible" {
+			t.Errorf("cookies sent to Audible = %v", cookies)
+		}
+	}
+}
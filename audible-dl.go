@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 )
 
 // If the -l or --log flag is passed, in addition to logging to an
@@ -29,6 +32,23 @@ type Book struct {
 	Authors      []string // ["Douglas Adams"]
 	Narrators    []string // ["Steven Fry"]
 	SeriesIndex  int      // 1
+	Account      string   // "Personal"
+	Codec        string   // "AAX_44_128"
+	Quality      string   // "highest"
+	Refused      []string // ["AAX: 403 Forbidden"]
+	Layout       string   // "audiobookshelf"
+	Chapters     []Chapter
+	Files        []BookFile
+}
+
+// Each file making up a downloaded book, including its sidecars, is
+// recorded in one of these so that we can tell if it's been moved or
+// modified since.  Path is relative to SaveDir, and SHA256 is the
+// file's checksum, which verify --checksums uses to catch bit rot.
+type BookFile struct {
+	Path   string
+	Size   int64
+	SHA256 string
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -41,34 +61,84 @@ type Book struct {
 ////////////////////////////////////////////////////////////////////////
 
 func main() {
-	account, harpath, aaxpath, savelog := getArgs()
+	args := getArgs()
 	cfgfile, datadir, tempdir, savedir := getPaths()
 	client := MakeClient(cfgfile, tempdir, savedir, datadir)
+	// On ^C, stop ffmpeg and any downloads and clean up after them
+	// instead of dying with partial files lying around.  Only those
+	// watch for it, so a second ^C kills us as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	client.ctx = ctx
+	client.SetQuality(args.Quality)
+
+	if args.BugReport != "" {
+		client.WriteBugReport(args.BugReport)
+		os.Exit(0)
+	}
+
+	// Converting a single file and printing chapters don't touch the
+	// state files, so they can run alongside another instance
+	readonly := len(args.Command) > 0 && args.Command[0] == "chapters"
+	if args.Single == "" && !readonly {
+		client.Lock()
+	}
+
+	if len(args.Command) > 0 {
+		runCommand(&client, args)
+		os.Exit(0)
+	}
+
+	client.GetBytes()
 	client.Validate()
 
-	if savelog {
+	if args.Log {
 		var err error
 		logFile, err = os.OpenFile(".audible-dl-debug.log",
 			os.O_WRONLY|os.O_CREATE, 0644)
 		expect(err, "Failed to open log file for writing")
 	}
 
-	if harpath != "" {
-		client.ImportCookies(account, harpath)
+	if args.Import != "" {
+		client.ImportCookies(args.Account, args.Import)
 		os.Exit(0)
 	}
 
-	if aaxpath != "" {
-		m4b := client.ConvertSingleBook(account, aaxpath)
-		fmt.Printf("%s: made %s\n", account, filepath.Base(m4b))
+	if args.Single != "" && isBatch(args.Single) {
+		if PrintBatchSummary(client.ConvertBatch(args.Account,
+			args.Single)) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if args.Single != "" {
+		m4b, name, err := client.ConvertSingleBook(args.Account,
+			args.Single)
+		unwrap(err)
+		fmt.Printf("%s: made %s\n", name, filepath.Base(m4b))
 		os.Exit(0)
 	}
 
 	client.GetCookies()
 	client.GetDownloaded()
-	client.ScrapeLibrary(account)
+	client.GetFailed()
+	var results []BookResult
+	if args.RetryFailed {
+		results = client.RetryFailed(args.Account)
+	} else {
+		results = client.ScrapeLibrary(args.Account)
+	}
 
 	logFile.Close()
+	if PrintSummary(results) {
+		os.Exit(1)
+	}
+	os.Exit(0)
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -79,7 +149,8 @@ func main() {
 //  \__,_|\__,_/_/\_\_|_|_|\__,_|_|  |_|\___||___/
 ////////////////////////////////////////////////////////////////////////
 
-const helpMessage string = `Usage: audible-dl [-h] [-a ACC] [-i HAR] [-s AAX]
+const helpMessage string = `Usage: audible-dl [-h] [-a ACC] [-q QUAL] [-i FILE] [-s AAX]
+       audible-dl COMMAND [ARGS...]
 
   Scrape your Audible library or convert an AAX file to m4b.
   See audible-dl(1) for more information.
@@ -87,9 +158,38 @@ const helpMessage string = `Usage: audible-dl [-h] [-a ACC] [-i HAR] [-s AAX]
 Options:
   -h, --help         Print this message and exit.
   -a, --account NAME Specify an account for the operation.
-  -i, --import  HAR  Import login cookies from HAR.
-  -s, --single  AAX  Convert the single AAX file specified in AAX.
+  -i, --import  FILE Import login cookies from a HAR, cookies.txt,
+                     or Firefox cookies.sqlite file.
+  -s, --single  AAX  Convert the single AAX file specified in AAX, or
+                     every AAX file in a directory or glob.
+  -q, --quality QUAL Download in QUAL: highest, high, normal, or low.
   -l, --log          Log scraper info to .audible-dl-debug.log
+      --bug-report F Bundle redacted debugging info into the tarball F.
+      --retry-failed Only retry books which failed in previous runs.
+
+Commands:
+  secrets lock       Encrypt all cookies and activation bytes.
+  secrets unlock     Decrypt all cookies and activation bytes.
+  quarantine         List books which have failed too often to retry.
+  upgrade            Re-download books archived below the configured
+                     quality.
+  chapters [-f FMT] [-t TITLES] [-asin ASIN] FILE
+                     Print FILE's chapters as ffmetadata, cue, json,
+                     or podcast (Podcasting 2.0) chapters.
+  sidecars           Write the configured sidecar files for every
+                     downloaded book.
+  reorganize [--dry-run]
+                     Move downloaded books into the configured layout,
+                     or with --dry-run, show where they would go.
+  verify [--checksums] [--repair]
+                     Check downloaded books' files against the store,
+                     with --checksums, check their contents too, and
+                     with --repair, fix what can be fixed.
+  import-existing [--review FILE] DIR
+                     Record the books archived by other tools in DIR
+                     as downloaded.
+  import-existing --accept FILE
+                     Record the matches accepted in a review FILE.
 `
 
 const debugScraperMessage string = `I encountered an error while scraping your library.
@@ -99,7 +199,7 @@ There are two likely causes of this:
      them with "audible-dl -i path/to/cookies.har -a %s", see the man
      page for details.
   2. Audible changed the structure of their website.  This is most likely the
-     case if the file .audible-dl-debug.html contains a list of books or
+     case if the file %s contains a list of books or
      otherwise looks like you were signed in correctly.
 
 If re-importing your cookies doesn't help, please email a bug report to
@@ -162,22 +262,90 @@ func getPaths() (string, string, string, string) {
 	return cfgfile, datadir, tempdir, savedir
 }
 
-// Read command-line arguments.
-func getArgs() (string, string, string, bool) {
-	var a, h, s string
-	var l bool
+// Run the subcommand in ARGS.Command, the positional arguments left
+// over after parsing flags.
+func runCommand(client *Client, args Args) {
+	cmd := args.Command
+	switch {
+	case len(cmd) == 2 && cmd[0] == "secrets" && cmd[1] == "lock":
+		client.LockSecrets()
+	case len(cmd) == 2 && cmd[0] == "secrets" && cmd[1] == "unlock":
+		client.UnlockSecrets()
+	case len(cmd) == 1 && cmd[0] == "quarantine":
+		client.GetFailed()
+		client.ListQuarantined()
+	case len(cmd) > 0 && cmd[0] == "chapters":
+		client.ChaptersCommand(args.Account, cmd[1:])
+	case len(cmd) == 1 && cmd[0] == "upgrade":
+		client.GetBytes()
+		client.Validate()
+		client.GetCookies()
+		client.GetDownloaded()
+		client.GetFailed()
+		if PrintSummary(client.UpgradeLibrary(args.Account)) {
+			os.Exit(1)
+		}
+	case len(cmd) == 1 && cmd[0] == "sidecars":
+		client.GetBytes()
+		client.Validate()
+		client.GetDownloaded()
+		client.SidecarsCommand(args.Account)
+	case len(cmd) > 0 && cmd[0] == "reorganize":
+		client.GetBytes()
+		client.Validate()
+		client.GetDownloaded()
+		client.ReorganizeCommand(args.Account, cmd[1:])
+	case len(cmd) > 0 && cmd[0] == "verify":
+		client.GetBytes()
+		client.Validate()
+		client.GetDownloaded()
+		client.VerifyCommand(args.Account, cmd[1:])
+	case len(cmd) > 0 && cmd[0] == "import-existing":
+		client.GetBytes()
+		client.Validate()
+		client.GetDownloaded()
+		client.ImportExistingCommand(args.Account, cmd[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n",
+			strings.Join(cmd, " "))
+		fmt.Fprintf(os.Stderr, helpMessage)
+		os.Exit(1)
+	}
+}
+
+// The command-line arguments, see helpMessage.
+type Args struct {
+	Account     string
+	Import      string
+	Single      string
+	BugReport   string
+	Quality     string
+	Log         bool
+	RetryFailed bool
+	Command     []string
+}
+
+// Read command-line arguments.  Any positional arguments are returned
+// as a subcommand.
+func getArgs() Args {
+	var args Args
 	// FIXME: prevent duplicate flags
-	flag.StringVar(&a, "a", "", "")
-	flag.StringVar(&h, "i", "", "")
-	flag.StringVar(&s, "s", "", "")
-	flag.BoolVar(&l, "l", false, "")
-	flag.StringVar(&a, "account", "", "")
-	flag.StringVar(&h, "import", "", "")
-	flag.StringVar(&s, "single", "", "")
-	flag.BoolVar(&l, "log", false, "")
+	flag.StringVar(&args.Account, "a", "", "")
+	flag.StringVar(&args.Import, "i", "", "")
+	flag.StringVar(&args.Single, "s", "", "")
+	flag.StringVar(&args.Quality, "q", "", "")
+	flag.BoolVar(&args.Log, "l", false, "")
+	flag.StringVar(&args.Account, "account", "", "")
+	flag.StringVar(&args.Import, "import", "", "")
+	flag.StringVar(&args.Single, "single", "", "")
+	flag.StringVar(&args.Quality, "quality", "", "")
+	flag.BoolVar(&args.Log, "log", false, "")
+	flag.StringVar(&args.BugReport, "bug-report", "", "")
+	flag.BoolVar(&args.RetryFailed, "retry-failed", false, "")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, helpMessage)
 	}
 	flag.Parse()
-	return a, h, s, l
+	args.Command = flag.Args()
+	return args
 }
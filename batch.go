@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+////////////////////////////////////////////////////////////////////////
+//  _           _       _
+// | |__   __ _| |_ ___| |__
+// | '_ \ / _` | __/ __| '_ \
+// | |_) | (_| | || (__| | | |
+// |_.__/ \__,_|\__\___|_| |_|
+////////////////////////////////////////////////////////////////////////
+
+// Return the path of the .m4b file that converting the .aax file in
+// AAXPATH creates.
+func m4bPath(aaxpath string) string {
+	if strings.HasSuffix(aaxpath, ".aax") {
+		return aaxpath[:len(aaxpath)-4] + ".m4b"
+	}
+	return aaxpath + ".m4b"
+}
+
+// Determine whether the argument to -s names more than one file,
+// either because it's a directory or a glob.  Something that exists is
+// taken literally, since books are often named like "Book
+// [Unabridged].aax".
+func isBatch(pattern string) bool {
+	if fi, err := os.Stat(pattern); err == nil {
+		return fi.IsDir()
+	}
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// Return every .aax file matched by the glob PATTERN, descending into
+// any directories it matches.
+func expandAAXPaths(pattern string) ([]string, error) {
+	matches := []string{pattern}
+	_, err := os.Stat(pattern)
+	if err != nil {
+		if matches, err = filepath.Glob(pattern); err != nil {
+			return nil, err
+		}
+	}
+	var paths []string
+	for _, m := range matches {
+		err = filepath.WalkDir(m, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.HasSuffix(path, ".aax") {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("No .aax files match " + pattern)
+	}
+	return paths, nil
+}
+
+// Return the account whose activation bytes unlock the .aax file in
+// PATH, which is found by comparing the checksum stored in the file
+// with the one derived from each account's bytes.
+func (c *Client) findAccountForAAX(path string) (*Account, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// A file with a damaged sample table is still worth trying to
+	// convert, so only its checksum is read here
+	aax, err := readAAXHeader(f)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read the checksum of %s: %s",
+			filepath.Base(path), err)
+	}
+	var tried, nobytes []string
+	for i := range c.Accounts {
+		a := &c.Accounts[i]
+		if a.Bytes == "" {
+			nobytes = append(nobytes, a.Name)
+			continue
+		}
+		if aax.checkBytes(a.Bytes) {
+			return a, nil
+		}
+		tried = append(tried, a.Name)
+	}
+	msg := fmt.Sprintf("None of your accounts' bytes unlock %s "+
+		"(tried %s)", filepath.Base(path), strings.Join(tried, ", "))
+	if len(nobytes) > 0 {
+		msg += fmt.Sprintf("; %s have no bytes configured",
+			strings.Join(nobytes, ", "))
+	}
+	return nil, errors.New(msg)
+}
+
+// Convert every .aax file matched by PATTERN, which may be a
+// directory or a glob, several at a time.  Each file is converted
+// with ACCOUNT's bytes, or if it's empty, with those of whichever
+// account they belong to.  Files which already have an .m4b next to
+// them are skipped.  The Title of each result is the file's path.
+func (c *Client) ConvertBatch(account, pattern string) []BookResult {
+	var fixed *Account
+	if account != "" {
+		name, err := c.NeedAccount(account)
+		unwrap(err)
+		fixed = c.FindAccount(name)
+	}
+	paths, err := expandAAXPaths(pattern)
+	unwrap(err)
+
+	results := make([]BookResult, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	nworkers := runtime.NumCPU()
+	if nworkers > len(paths) {
+		nworkers = len(paths)
+	}
+	for w := 0; w < nworkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = c.convertBatchFile(fixed, paths[i])
+				fmt.Printf("%s %s...%s\n", bold("Converting Book"),
+					paths[i], results[i].Status)
+			}
+		}()
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// Convert the .aax file in PATH for ConvertBatch() with A's bytes, or
+// the bytes of the account it belongs to if A is nil.
+func (c *Client) convertBatchFile(a *Account, path string) BookResult {
+	r := BookResult{Title: path, Status: BookFailed}
+	if c.ctx.Err() != nil {
+		r.Reason = "interrupted"
+		return r
+	}
+	m4b := m4bPath(path)
+	if _, err := os.Stat(m4b); err == nil {
+		r.Status = BookSkipped
+		r.Reason = filepath.Base(m4b) + " already exists"
+		return r
+	}
+	if a == nil {
+		var err error
+		if a, err = c.findAccountForAAX(path); err != nil {
+			r.Reason = err.Error()
+			return r
+		}
+	}
+	r.Account = a.Name
+
+	// There's no sensible way to show several progress bars at once
+	ch := make(chan float64)
+	go func() {
+		for range ch {
+		}
+	}()
+	err, stderr := a.Convert(path, m4b, c, ch)
+	if err != nil {
+		r.Reason = err.Error()
+		lines := strings.Split(strings.TrimSpace(string(stderr)), "\n")
+		if last := lines[len(lines)-1]; last != "" {
+			r.Reason += ": " + a.Redact(last)
+		}
+		return r
+	}
+	r.Status = BookConverted
+	return r
+}
+
+// Print a table of what happened to each file in RESULTS from
+// ConvertBatch().  Returns true if anything failed.
+func PrintBatchSummary(results []BookResult) bool {
+	width := len("File")
+	for _, r := range results {
+		if len(r.Title) > width {
+			width = len(r.Title)
+		}
+	}
+	failed := false
+	fmt.Printf("\n%s\n", bold("Summary"))
+	fmt.Printf("%-*s %-20s %-10s %s\n", width, "File", "Account",
+		"Result", "Reason")
+	for _, r := range results {
+		fmt.Printf("%-*s %-20s %-10s %s\n", width, r.Title, r.Account,
+			r.Status, r.Reason)
+		if r.Status == BookFailed {
+			failed = true
+		}
+	}
+	return failed
+}
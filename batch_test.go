@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A file whose sample table is damaged still belongs to an account.
+func TestFindAccountForAAX(t *testing.T) {
+	c := testClient(t, nil)
+	c.Accounts = []Account{
+		{Name: "other", Bytes: "cafebabe"},
+		{Name: "test", Bytes: testActivation},
+	}
+	good := testFile(t, testAAX(nil)).Name()
+	bad := testFile(t, testAAX(func(stsz []byte) []byte {
+		binary.BigEndian.PutUint32(stsz[8:], 1000)
+		return stsz
+	})).Name()
+	for _, path := range []string{good, bad} {
+		a, err := c.findAccountForAAX(path)
+		if err != nil {
+			t.Errorf("findAccountForAAX(%s) = %s", path, err)
+		} else if a.Name != "test" {
+			t.Errorf("findAccountForAAX(%s) = %s", path, a.Name)
+		}
+	}
+	c.Accounts = c.Accounts[:1]
+	if _, err := c.findAccountForAAX(good); err == nil {
+		t.Errorf("findAccountForAAX() matched the wrong bytes")
+	}
+}
+
+// Existing files and directories are taken literally even if their
+// names look like globs.
+func TestIsBatch(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "Book [Unabridged].aax")
+	sub := filepath.Join(dir, "Series [1-3]")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "a.aax"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		batch bool
+	}{
+		{file, false},
+		{sub, true},
+		{filepath.Join(dir, "*.aax"), true},
+	}
+	for _, tt := range tests {
+		if got := isBatch(tt.path); got != tt.batch {
+			t.Errorf("isBatch(%s) = %v", tt.path, got)
+		}
+	}
+	paths, err := expandAAXPaths(sub)
+	if err != nil || len(paths) != 1 {
+		t.Errorf("expandAAXPaths(%s) = %v, %v", sub, paths, err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////
+//  _                                           _
+// | |__  _   _  __ _   _ __ ___ _ __   ___  _ __| |_ ___
+// | '_ \| | | |/ _` | | '__/ _ \ '_ \ / _ \| '__| __/ __|
+// | |_) | |_| | (_| | | | |  __/ |_) | (_) | |  | |_\__ \
+// |_.__/ \__,_|\__, | |_|  \___| .__/ \___/|_|   \__|___/
+//              |___/           |_|
+////////////////////////////////////////////////////////////////////////
+
+// When the scraper fails its log buffer and the page it failed on are
+// saved to these files in DataDir so that they can be included in a
+// bug report later.
+const scraperLogFile string = "scraper.log"
+const failedPageFile string = "debug.html"
+
+// Bundle everything useful for debugging a scraper failure into the
+// gzipped tarball in PATH: the last page the scraper choked on, the
+// scraper logs, version information for audible-dl and ffmpeg, and
+// the config file.  Everything is run through every account's
+// redactor on the way in, so the result should be safe to email.
+func (c *Client) WriteBugReport(path string) {
+	c.loadCookiesForRedaction()
+
+	out, err := os.Create(path)
+	expect(err, "Failed to create "+path)
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	add := func(name string, data []byte) {
+		hdr := &tar.Header{
+			Name:    "audible-dl-bug-report/" + name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: time.Now(),
+		}
+		unwrap(tw.WriteHeader(hdr))
+		_, err := tw.Write(data)
+		unwrap(err)
+	}
+	addFile := func(name, path string) {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				unwrap(err)
+			}
+			fmt.Printf("Skipping %s, it doesn't exist\n", path)
+			return
+		}
+		add(name, []byte(c.Redact(string(raw))))
+	}
+
+	add("version.txt", []byte(c.Redact(versionInfo())))
+	add("config.yml", c.sanitizedConfig())
+	addFile("debug.html", c.DataDir+failedPageFile)
+	addFile("debug.log", ".audible-dl-debug.log")
+	addFile("scraper.log", c.DataDir+scraperLogFile)
+
+	unwrap(tw.Close())
+	unwrap(gz.Close())
+	unwrap(out.Close())
+	fmt.Printf("Wrote bug report to %s, please check it over before "+
+		"sending it\n", path)
+}
+
+// Return S redacted with respect to every configured account.
+func (c *Client) Redact(s string) string {
+	for i := range c.Accounts {
+		s = c.Accounts[i].Redact(s)
+	}
+	return s
+}
+
+// Load whatever cookies can be read without prompting for a
+// passphrase or running a command so that their values can be
+// redacted.  Unlike GetCookies(), failure isn't fatal.
+func (c *Client) loadCookiesForRedaction() {
+	for i := range c.Accounts {
+		a := &c.Accounts[i]
+		path := c.cookiesPath(a.Name)
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		a.Auth, _ = parseCookies(path, raw)
+	}
+}
+
+// The config fields whose values are secrets.
+var secretConfigKeys = map[string]bool{
+	"bytes":           true,
+	"bytes_command":   true,
+	"cookies_command": true,
+	"keyfile":         true,
+}
+
+// Return the config file as yaml with every secret replaced.  It's
+// read as yaml rather than copied out of the client so that every
+// setting makes it into the report, including ones added after this
+// was written.
+func (c *Client) sanitizedConfig() []byte {
+	raw, err := os.ReadFile(c.cfgfile)
+	unwrap(err)
+	var cfg interface{}
+	expect(yaml.Unmarshal(raw, &cfg), "Bad yaml in config file")
+	raw, err = yaml.Marshal(c.sanitizeConfigValue("", cfg))
+	unwrap(err)
+	return raw
+}
+
+// Return V, the value of KEY in the config file, with its secrets
+// replaced.  Account names are replaced by their pseudonyms, and
+// everything else is run through the redactors in case it mentions
+// something it shouldn't.
+func (c *Client) sanitizeConfigValue(key string, v interface{}) interface{} {
+	if secretConfigKeys[key] {
+		if v == nil || v == "" {
+			return v
+		}
+		return redacted
+	}
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		for k, x := range v {
+			v[k] = c.sanitizeConfigValue(strings.ToLower(fmt.Sprint(k)), x)
+		}
+	case []interface{}:
+		for i, x := range v {
+			v[i] = c.sanitizeConfigValue(key, x)
+		}
+	case string:
+		if key == "name" {
+			return (&Account{Name: v}).pseudonym()
+		}
+		return c.Redact(v)
+	}
+	return v
+}
+
+// Return a description of the environment audible-dl is running in.
+func versionInfo() string {
+	ret := "audible-dl: "
+	if info, ok := debug.ReadBuildInfo(); ok {
+		ret += info.Main.Version
+		for _, s := range info.Settings {
+			if strings.HasPrefix(s.Key, "vcs.") {
+				ret += " " + s.Key + "=" + s.Value
+			}
+		}
+	} else {
+		ret += "unknown"
+	}
+	ret += "\n"
+	ret += "go: " + runtime.Version() + " " + runtime.GOOS + "/" +
+		runtime.GOARCH + "\n"
+	ffmpeg, err := exec.Command("ffmpeg", "-version").Output()
+	if err != nil {
+		ret += "ffmpeg: " + err.Error() + "\n"
+	} else {
+		ret += "ffmpeg: " + strings.SplitN(string(ffmpeg), "\n", 2)[0] +
+			"\n"
+	}
+	return ret
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Every setting but the secrets makes it into a bug report.
+func TestSanitizedConfig(t *testing.T) {
+	c := testClient(t, nil)
+	c.cfgfile = c.DataDir + "config.yml"
+	c.Accounts = []Account{{Name: "Personal", Bytes: "deadbeef"}}
+	cfg := `version: 1
+layout: plex
+keyfile: /home/me/.audible-key
+accounts:
+  - name: "Personal"
+    bytes: 12345678
+    cookies_command: "pass show audible/cookies"
+    format: opus
+    sidecars: [desc, nfo]
+`
+	if err := os.WriteFile(c.cfgfile, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got := string(c.sanitizedConfig())
+	for _, want := range []string{"layout: plex", "format: opus", "- nfo",
+		"name: " + c.Accounts[0].pseudonym()} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sanitized config is missing %q:\n%s", want, got)
+		}
+	}
+	for _, secret := range []string{"Personal", "12345678", "pass show",
+		".audible-key"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("sanitized config contains %q:\n%s", secret, got)
+		}
+	}
+}
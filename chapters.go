@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////
+//       _                 _
+//   ___| |__   __ _ _ __ | |_ ___ _ __ ___
+//  / __| '_ \ / _` | '_ \| __/ _ \ '__/ __|
+// | (__| | | | (_| | |_) | ||  __/ |  \__ \
+//  \___|_| |_|\__,_| .__/ \__\___|_|  |___/
+//                  |_|
+////////////////////////////////////////////////////////////////////////
+
+// A single chapter of a book.  Start and End are in seconds.
+type Chapter struct {
+	Title string
+	Start float64
+	End   float64
+}
+
+// Matches the placeholder titles Audible gives chapters in the AAX
+// file itself, like "Chapter 1" or "01".
+var genericChapterRegexp = regexp.MustCompile(`(?i)^(chapter\s*)?\d+$`)
+
+// Audible only gives the real chapter titles to registered devices,
+// but Audnexus passes them on to anyone who asks, by ASIN, which is
+// what a Book calls its Slug.
+var chapterTitlesURL = "https://api.audnex.us/books/%s/chapters"
+
+// Read the chapters out of the .aax or .m4b file in PATH with ffprobe.
+// BYTES are the activation bytes needed to open an .aax file, and may
+// be empty for an .m4b.
+func probeChapters(path, bytes string) ([]Chapter, error) {
+	args := []string{"-v", "quiet", "-print_format", "json",
+		"-show_chapters"}
+	if bytes != "" {
+		args = append(args, "-activation_bytes", bytes)
+	}
+	out, err := exec.Command("ffprobe", append(args, path)...).Output()
+	if err != nil {
+		return nil, err
+	}
+	var probe struct {
+		Chapters []struct {
+			StartTime string `json:"start_time"`
+			EndTime   string `json:"end_time"`
+			Tags      struct {
+				Title string `json:"title"`
+			} `json:"tags"`
+		} `json:"chapters"`
+	}
+	if err = json.Unmarshal(out, &probe); err != nil {
+		return nil, err
+	}
+	var chapters []Chapter
+	for _, c := range probe.Chapters {
+		start, _ := strconv.ParseFloat(c.StartTime, 64)
+		end, _ := strconv.ParseFloat(c.EndTime, 64)
+		chapters = append(chapters, Chapter{
+			Title: c.Tags.Title,
+			Start: start,
+			End:   end,
+		})
+	}
+	return chapters, nil
+}
+
+// Replace the generic titles of CHAPTERS with the corresponding ones in
+// TITLES.  If the number of titles doesn't match the number of
+// chapters we can't tell which is which, so nothing is replaced.
+func mergeChapterTitles(chapters []Chapter, titles []string) {
+	if len(titles) != len(chapters) {
+		return
+	}
+	for i := range chapters {
+		if isGenericTitle(chapters[i].Title) && titles[i] != "" {
+			chapters[i].Title = titles[i]
+		}
+	}
+}
+
+// Whether TITLE is missing or a placeholder.
+func isGenericTitle(title string) bool {
+	title = strings.TrimSpace(title)
+	return title == "" || genericChapterRegexp.MatchString(title)
+}
+
+// Whether any of CHAPTERS has a placeholder title.
+func hasGenericTitles(chapters []Chapter) bool {
+	for _, ch := range chapters {
+		if isGenericTitle(ch.Title) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch the real titles of the chapters of the book whose ASIN is
+// ASIN, in order.
+func (c *Client) fetchChapterTitles(asin string) ([]string, error) {
+	uri := fmt.Sprintf(chapterTitlesURL, url.PathEscape(asin))
+	req, _ := http.NewRequestWithContext(c.ctx, "GET", uri, nil)
+	httpcl := &http.Client{Timeout: 30 * time.Second}
+	resp, err := httpcl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("chapter titles: " + resp.Status)
+	}
+	var doc struct {
+		Chapters []struct {
+			Title string `json:"title"`
+		} `json:"chapters"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var titles []string
+	for _, ch := range doc.Chapters {
+		titles = append(titles, strings.TrimSpace(ch.Title))
+	}
+	return titles, nil
+}
+
+// Replace the placeholder titles of CHAPTERS, which were read from the
+// m4b file in M4B converted from book B, with the real ones, both in
+// the file and in the returned copy.  This sends the book's ASIN to
+// Audnexus, so it's only done if the user asked for it.  If the titles
+// can't be fetched or don't fit, CHAPTERS is returned as it was, since
+// it's no reason to fail the book.
+func (c *Client) titleChapters(a *Account, b *Book, m4b string, chapters []Chapter) []Chapter {
+	if !c.Audnexus || b.Slug == "" || !hasGenericTitles(chapters) {
+		return chapters
+	}
+	titles, err := c.fetchChapterTitles(b.Slug)
+	if err != nil {
+		a.Log("Failed to fetch chapter titles for %s: %s", b.Title, err)
+		return chapters
+	}
+	titled := append([]Chapter(nil), chapters...)
+	mergeChapterTitles(titled, titles)
+	if err = writeChapters(m4b, titled); err != nil {
+		a.Log("Failed to title the chapters of %s: %s", b.Title, err)
+		return chapters
+	}
+	return titled
+}
+
+// Replace the chapters of the m4b file in PATH with CHAPTERS, copying
+// everything else as it is.
+func writeChapters(path string, chapters []Chapter) error {
+	meta := path + ".chapters.txt"
+	tmp := path + ".tmp.m4b"
+	defer os.Remove(meta)
+	defer os.Remove(tmp)
+	err := os.WriteFile(meta, []byte(chaptersFFMetadata(chapters)), 0644)
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command("ffmpeg", "-y", "-v", "error", "-i", path,
+		"-f", "ffmetadata", "-i", meta, "-map", "0",
+		"-map_metadata", "0", "-map_chapters", "1", "-c", "copy",
+		tmp).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(tmp, path)
+}
+
+// Return CHAPTERS in FORMAT, which is one of "ffmetadata", "cue",
+// "json", or "podcast" (Podcasting 2.0 json chapters).  AUDIO is the
+// name of the file they belong to, which cue sheets need.
+func exportChapters(chapters []Chapter, format, audio string) (string, error) {
+	switch format {
+	case "ffmetadata":
+		return chaptersFFMetadata(chapters), nil
+	case "cue":
+		return chaptersCue(chapters, audio), nil
+	case "json":
+		raw, err := json.MarshalIndent(chapters, "", "  ")
+		return string(raw) + "\n", err
+	case "podcast":
+		return chaptersPodcast(chapters)
+	}
+	return "", errors.New("Unknown chapter format " + format)
+}
+
+// Return CHAPTERS as an ffmpeg metadata file, which can be fed back
+// into ffmpeg with -i chapters.txt -map_metadata 1.
+func chaptersFFMetadata(chapters []Chapter) string {
+	escape := strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`,
+		"#", `\#`, "\n", "\\\n")
+	ret := ";FFMETADATA1\n"
+	for _, c := range chapters {
+		ret += "\n[CHAPTER]\nTIMEBASE=1/1000\n"
+		ret += fmt.Sprintf("START=%d\n", int64(c.Start*1000))
+		ret += fmt.Sprintf("END=%d\n", int64(c.End*1000))
+		ret += "title=" + escape.Replace(c.Title) + "\n"
+	}
+	return ret
+}
+
+// Return CHAPTERS as a cue sheet for the file AUDIO.  Cue timestamps
+// are minutes, seconds, and frames, of which there are 75 a second.
+func chaptersCue(chapters []Chapter, audio string) string {
+	quote := strings.NewReplacer(`"`, `'`)
+	ret := fmt.Sprintf("FILE \"%s\" MP4\n", quote.Replace(audio))
+	for i, c := range chapters {
+		frames := int64(c.Start * 75)
+		ret += fmt.Sprintf("  TRACK %02d AUDIO\n", i+1)
+		ret += fmt.Sprintf("    TITLE \"%s\"\n", quote.Replace(c.Title))
+		ret += fmt.Sprintf("    INDEX 01 %02d:%02d:%02d\n",
+			frames/75/60, frames/75%60, frames%75)
+	}
+	return ret
+}
+
+// Return CHAPTERS in the Podcasting 2.0 json chapters format.
+func chaptersPodcast(chapters []Chapter) (string, error) {
+	type chapter struct {
+		StartTime float64 `json:"startTime"`
+		EndTime   float64 `json:"endTime"`
+		Title     string  `json:"title"`
+	}
+	doc := struct {
+		Version  string    `json:"version"`
+		Chapters []chapter `json:"chapters"`
+	}{Version: "1.2.0"}
+	for _, c := range chapters {
+		doc.Chapters = append(doc.Chapters,
+			chapter{c.Start, c.End, c.Title})
+	}
+	raw, err := json.MarshalIndent(doc, "", "  ")
+	return string(raw) + "\n", err
+}
+
+// Read a list of chapter titles, one per line, from the file in PATH.
+func readChapterTitles(path string) []string {
+	raw, err := os.ReadFile(path)
+	unwrap(err)
+	var titles []string
+	for _, l := range strings.Split(string(raw), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			titles = append(titles, l)
+		}
+	}
+	return titles
+}
+
+// Implement the chapters subcommand, which prints the chapters of an
+// .aax or .m4b file in the requested format.  The AAX files Audible
+// serves usually name their chapters "Chapter 1" and so on.  Given the
+// book's ASIN with -asin, the real titles are fetched to replace the
+// generic names, or they can be pasted into a file, one per line, and
+// passed with -t.
+func (c *Client) ChaptersCommand(account string, argv []string) {
+	fs := flag.NewFlagSet("chapters", flag.ExitOnError)
+	format := fs.String("f", "json", "")
+	titles := fs.String("t", "", "")
+	asin := fs.String("asin", "", "")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: audible-dl chapters "+
+			"[-f ffmetadata|cue|json|podcast] [-t TITLES] "+
+			"[-asin ASIN] FILE\n")
+	}
+	fs.Parse(argv)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	path := fs.Arg(0)
+
+	var bytes string
+	if strings.HasSuffix(path, ".aax") {
+		c.GetBytes()
+		if account == "" && len(c.Accounts) > 1 {
+			a, err := c.findAccountForAAX(path)
+			unwrap(err)
+			bytes = a.Bytes
+		} else {
+			name, err := c.NeedAccount(account)
+			unwrap(err)
+			bytes = c.FindAccount(name).Bytes
+		}
+	}
+	chapters, err := probeChapters(path, bytes)
+	expect(err, "Failed to read chapters from "+path)
+
+	if *titles != "" {
+		mergeChapterTitles(chapters, readChapterTitles(*titles))
+	} else if *asin != "" {
+		fetched, err := c.fetchChapterTitles(*asin)
+		expect(err, "Failed to fetch the chapter titles of "+*asin)
+		mergeChapterTitles(chapters, fetched)
+	}
+
+	out, err := exportChapters(chapters, *format, filepath.Base(path))
+	unwrap(err)
+	fmt.Print(out)
+}
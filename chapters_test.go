@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Serve Audnexus's answer for the book B0000TEST and nothing else,
+// returning the number of requests made so far.
+func testAudnexus(t *testing.T) *int {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/books/B0000TEST/chapters" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"asin": "B0000TEST", "chapters": [
+			{"lengthMs": 1000, "startOffsetMs": 0, "title": "Opening Credits"},
+			{"lengthMs": 5000, "startOffsetMs": 1000, "title": " The Beginning "},
+			{"lengthMs": 2000, "startOffsetMs": 6000, "title": "End Credits"}
+		]}`))
+	}))
+	t.Cleanup(srv.Close)
+	old := chapterTitlesURL
+	chapterTitlesURL = srv.URL + "/books/%s/chapters"
+	t.Cleanup(func() { chapterTitlesURL = old })
+	return &requests
+}
+
+func TestFetchChapterTitles(t *testing.T) {
+	testAudnexus(t)
+	c := testClient(t, nil)
+	titles, err := c.fetchChapterTitles("B0000TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Opening Credits", "The Beginning", "End Credits"}
+	if len(titles) != len(want) {
+		t.Fatalf("fetchChapterTitles() = %q, want %q", titles, want)
+	}
+	for i := range want {
+		if titles[i] != want[i] {
+			t.Errorf("title %d = %q, want %q", i, titles[i], want[i])
+		}
+	}
+	if _, err = c.fetchChapterTitles("B0000GONE"); err == nil {
+		t.Errorf("fetchChapterTitles() of an unknown book succeeded")
+	}
+}
+
+// Books' ASINs are only sent to Audnexus when the user asks for it.
+func TestTitleChaptersOptIn(t *testing.T) {
+	requests := testAudnexus(t)
+	c := testClient(t, nil)
+	b := &Book{Title: "A Book", Slug: "B0000TEST"}
+	chapters := []Chapter{{Title: "Chapter 1"}, {Title: "Chapter 2"},
+		{Title: "Chapter 3"}}
+	got := c.titleChapters(&c.Accounts[0], b, c.SaveDir+"A_Book.m4b",
+		chapters)
+	if *requests != 0 {
+		t.Errorf("Audnexus was asked about the book without audnexus set")
+	}
+	if got[0].Title != "Chapter 1" {
+		t.Errorf("chapters were retitled without audnexus set")
+	}
+}
+
+func TestMergeChapterTitles(t *testing.T) {
+	chapters := []Chapter{{Title: "Chapter 1"}, {Title: "Prologue"},
+		{Title: "03"}}
+	mergeChapterTitles(chapters, []string{"One", "Two", "Three"})
+	for i, want := range []string{"One", "Prologue", "Three"} {
+		if chapters[i].Title != want {
+			t.Errorf("title %d = %q, want %q", i, chapters[i].Title, want)
+		}
+	}
+	if hasGenericTitles(chapters) {
+		t.Errorf("hasGenericTitles() = true after merging")
+	}
+	// Titles which can't be lined up with the chapters are ignored
+	mergeChapterTitles(chapters, []string{"Too", "Few"})
+	if chapters[0].Title != "One" {
+		t.Errorf("title 0 = %q after merging too few", chapters[0].Title)
+	}
+}
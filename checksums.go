@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////
+//       _               _
+//   ___| |__   ___  ___| | _____ _   _ _ __ ___  ___
+//  / __| '_ \ / _ \/ __| |/ / __| | | | '_ ` _ \/ __|
+// | (__| | | |  __/ (__|   <\__ \ |_| | | | | | \__ \
+//  \___|_| |_|\___|\___|_|\_\___/\__,_|_| |_| |_|___/
+////////////////////////////////////////////////////////////////////////
+
+// With the manifests config field set, every directory in SaveDir
+// holding books gets a file of this name listing the checksums of its
+// files in the format sha256sum(1) checks.
+const manifestName string = "SHA256SUMS"
+
+// What verify --checksums found last time is kept in this file in
+// DataDir so that the next run can say what's changed since.
+const verifyStateFile string = "last_verified.json"
+
+// When verify --checksums last ran, and since when each file which
+// failed its checksum has been failing.
+type verifyState struct {
+	Version int
+	Time    time.Time
+	Corrupt map[string]time.Time
+}
+
+// Return the hex SHA-256 of the file in PATH.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Record the checksums of every file of B which doesn't have one yet.
+func (c *Client) hashFiles(b *Book) {
+	for i := range b.Files {
+		f := &b.Files[i]
+		if f.SHA256 != "" {
+			continue
+		}
+		sum, err := hashFile(c.absPath(f.Path))
+		if os.IsNotExist(err) {
+			// It's up to verify to report missing files
+			continue
+		} else if err != nil {
+			log.Printf("Failed to checksum %s: %s", f.Path, err)
+			continue
+		}
+		f.SHA256 = sum
+	}
+}
+
+// Rewrite the manifests of every directory in SaveDir holding files of
+// book ONLY, or of any book if it's nil, if the config file asks for
+// them.  A manifest lists every book in its directory, not just ONLY.
+func (c *Client) writeManifests(only *Book) {
+	if !c.Manifests {
+		return
+	}
+	dirs := make(map[string]bool)
+	for _, b := range c.Downloaded {
+		if only != nil && b.Title != only.Title {
+			continue
+		}
+		for _, f := range b.Files {
+			if !filepath.IsAbs(f.Path) {
+				dirs[filepath.Dir(f.Path)] = true
+			}
+		}
+	}
+	for dir := range dirs {
+		sums := make(map[string]string)
+		var names []string
+		for _, b := range c.Downloaded {
+			for _, f := range b.Files {
+				if f.SHA256 != "" && !filepath.IsAbs(f.Path) &&
+					filepath.Dir(f.Path) == dir {
+					name := filepath.Base(f.Path)
+					sums[name] = f.SHA256
+					names = append(names, name)
+				}
+			}
+		}
+		sort.Strings(names)
+		var lines []string
+		for _, name := range names {
+			lines = append(lines, sums[name]+"  "+name+"\n")
+		}
+		path := filepath.Join(c.SaveDir, dir, manifestName)
+		err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0644)
+		if err != nil {
+			log.Printf("Failed to write %s: %s", path, err)
+		}
+	}
+}
+
+// Check the checksum of every recorded file which isn't in SKIP,
+// returning those which no longer match as problems.  Files without a
+// checksum, including every file of books which predate us recording
+// them, have theirs recorded instead.  The problems are compared with
+// the last run's, printing what's changed, and remembered for the
+// next.
+func (c *Client) checkSums(skip map[string]bool) []fileProblem {
+	var state verifyState
+	statePath := c.DataDir + verifyStateFile
+	if raw, err := os.ReadFile(statePath); err == nil {
+		raw, err = upgradeState(stateVerified, statePath, raw, nil)
+		unwrap(err)
+		expect(json.Unmarshal(raw, &state), "Bad json in "+verifyStateFile)
+	} else if !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	if state.Time.IsZero() {
+		fmt.Println("Checking checksums for the first time")
+	} else {
+		fmt.Printf("Checking checksums, last checked %s\n",
+			state.Time.Format("2006-01-02 15:04"))
+	}
+
+	now := time.Now()
+	next := verifyState{
+		Version: currentVersion(stateVerified),
+		Time:    now,
+		Corrupt: make(map[string]time.Time),
+	}
+	var problems []fileProblem
+	recorded := 0
+	titles := make([]string, 0, len(c.Downloaded))
+	for title := range c.Downloaded {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	for _, title := range titles {
+		if c.ctx.Err() != nil {
+			log.Fatal("Interrupted while checking checksums")
+		}
+		b := c.Downloaded[title]
+		b.Files = c.bookFiles(&b, "")
+		for i := range b.Files {
+			f := &b.Files[i]
+			if skip[f.Path] {
+				continue
+			}
+			sum, err := hashFile(c.absPath(f.Path))
+			if err != nil {
+				continue
+			}
+			if f.SHA256 == "" {
+				f.SHA256 = sum
+				recorded++
+				continue
+			}
+			if sum == f.SHA256 {
+				continue
+			}
+			p := fileProblem{Kind: FileCorrupt, Book: title, File: *f}
+			next.Corrupt[f.Path] = now
+			if since, ok := state.Corrupt[f.Path]; ok {
+				p.Since = since
+				next.Corrupt[f.Path] = since
+			}
+			problems = append(problems, p)
+		}
+		c.Downloaded[title] = b
+	}
+
+	for path, since := range state.Corrupt {
+		if skip[path] {
+			next.Corrupt[path] = since
+		} else if _, ok := next.Corrupt[path]; !ok {
+			fmt.Printf("%-9s %s\n", "recovered", path)
+		}
+	}
+	if recorded > 0 {
+		fmt.Printf("Recorded the checksums of %d files\n", recorded)
+		c.SetDownloaded()
+		c.writeManifests(nil)
+	}
+	raw, _ := json.MarshalIndent(next, "", "  ")
+	unwrap(writeFileAtomic(statePath, raw, 0644))
+	return problems
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,7 +11,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Escape code clear a line and move the cursor to the beginning
@@ -37,22 +41,54 @@ func bold(s string) string {
 // Downloaded is map of all the books we've previously downloaded.
 // This map is populated from a cache file which exists to allow the
 // user to rename and organize their collection after they've been
-// downloaded.
+// downloaded.  Failed is a similar map of books which failed to
+// download or convert, and MaxAttempts is how many times a book may
+// fail before it's quarantined.  KeyFile optionally names a file
+// whose contents are used in place of a passphrase to encrypt secrets
+// at rest.  Converter and ConverterCommand select how .aax files are
+// decrypted, see converter().  Manifests asks for a SHA256SUMS file in
+// every directory of books.  Audnexus allows the real titles of
+// generically named chapters to be looked up by ASIN on a third-party
+// site, see titleChapters().
 type Client struct {
-	SaveDir    string
-	TempDir    string
-	DataDir    string
-	Accounts   []Account
-	Downloaded map[string]Book
+	SaveDir          string
+	TempDir          string
+	DataDir          string
+	KeyFile          string
+	MaxAttempts      int
+	Layout           string
+	Verify           bool
+	VerifyTolerance  int
+	Manifests        bool
+	Audnexus         bool
+	Converter        string
+	ConverterCommand string `yaml:"converter_command"`
+	Accounts         []Account
+	Downloaded       map[string]Book
+	Failed           map[string]FailedBook
+	secret           []byte
+	runQuality       string
+	rotated          map[string]bool
+	cfgfile          string
+	ctx              context.Context
+	conv             Converter // Used instead of Converter by the tests
 }
 
 // Return a Client struct partially populated from the .yml file
 // passed in CFGFILE.
 func MakeClient(cfgfile, tempdir, savedir, datadir string) Client {
 	var client Client
+	client.ctx = context.Background()
+	client.cfgfile = cfgfile
 	client.Downloaded = make(map[string]Book)
+	client.Failed = make(map[string]FailedBook)
 	raw, err := os.ReadFile(cfgfile)
 	expect(err, "Please create the config file with at least one account")
+	// The config file belongs to the user, who may keep it read-only or
+	// symlinked into a dotfiles repository, so it's only upgraded in
+	// memory
+	raw, err = upgradeState(stateConfig, cfgfile, raw, nil)
+	unwrap(err)
 	expect(yaml.Unmarshal(raw, &client), "Bad yaml in config file")
 	client.TempDir = tempdir
 	client.DataDir = datadir
@@ -75,14 +111,23 @@ func (c *Client) Validate() {
 	if len(c.Accounts) == 0 {
 		log.Fatal("Couldn't find any accounts in config file.")
 	}
+	if _, err := c.converter(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := getLayout(c.Layout); err != nil {
+		log.Fatal(err)
+	}
 	for _, a := range c.Accounts {
 		if a.Name == "" {
 			log.Fatal("Account name not specified in config file.")
 		}
-		if a.Bytes == "" {
+		if a.Bytes == "" && a.BytesCommand == "" {
 			log.Fatal("Activation bytes not present for account " +
 				a.Name)
 		}
+		if err := a.validateOutput(); err != nil {
+			log.Fatalf("Account %s: %s", a.Name, err)
+		}
 		// It's okay not to have cookies
 	}
 }
@@ -117,62 +162,176 @@ func (c *Client) NeedAccount(account string) (string, error) {
 	return account, nil
 }
 
-// Given a .har file containing a full archive of a GET request to
-// audible.com/library/titles in HARPATH, import the cookies therein
-// into ACCOUNT's cookie store.
-func (c *Client) ImportCookies(account, harpath string) {
+// Given a file in PATH containing cookies for audible.com, import
+// them into ACCOUNT's cookie store.  The file may be a .har archive
+// of a GET request to audible.com/library/titles, a Netscape-format
+// cookies.txt, or a Firefox cookies.sqlite database (or the profile
+// directory containing it); the format is inferred from its contents.
+func (c *Client) ImportCookies(account, path string) {
 	account, err := c.NeedAccount(account)
-	authpath := c.DataDir + account + ".cookies.json"
+	authpath := c.cookiesPath(account)
 	unwrap(err)
 	a := c.FindAccount(account)
-	raw, err := ioutil.ReadFile(harpath)
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, "cookies.sqlite")
+	}
+	raw, err := ioutil.ReadFile(path)
 	unwrap(err)
-	a.ImportCookiesFromHAR(raw)
-	json, _ := json.MarshalIndent(a.Auth, "", "  ")
-	unwrap(ioutil.WriteFile(authpath, json, 0644))
-	fmt.Printf("Imported cookies from %s into %s\n", harpath, authpath)
+	switch cookieFileFormat(raw) {
+	case "har":
+		a.ImportCookiesFromHAR(raw)
+	case "netscape":
+		a.ImportCookiesFromNetscape(raw)
+	case "firefox":
+		a.ImportCookiesFromFirefox(path, c)
+	default:
+		log.Fatalf("Couldn't determine the format of %s", path)
+	}
+	if len(a.Auth) == 0 {
+		log.Fatalf("Couldn't find any Audible cookies in %s", path)
+	}
+	json, _ := json.MarshalIndent(cookieFile{
+		Version: currentVersion(stateCookies),
+		Cookies: a.Auth,
+	}, "", "  ")
+	// Keep the cookies encrypted if the user has locked their secrets
+	if _, err := os.Stat(authpath + secretSuffix); err == nil {
+		authpath += secretSuffix
+		c.writeSealed(authpath, json)
+	} else {
+		unwrap(writeFileAtomic(authpath, json, 0644))
+	}
+	fmt.Printf("Imported cookies from %s into %s\n", path, authpath)
+}
+
+// Guess the format of the cookie file passed in RAW, returning one of
+// "har", "netscape", "firefox", or an empty string.
+func cookieFileFormat(raw []byte) string {
+	if bytes.HasPrefix(raw, []byte("SQLite format 3\x00")) {
+		return "firefox"
+	}
+	trimmed := bytes.TrimSpace(raw)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		return "har"
+	}
+	for _, line := range strings.Split(string(trimmed), "\n") {
+		if strings.HasPrefix(line, "# Netscape HTTP Cookie File") ||
+			strings.HasPrefix(line, "# HTTP Cookie File") ||
+			len(strings.Split(line, "\t")) == 7 {
+			return "netscape"
+		}
+	}
+	return ""
 }
 
 // Using ACCOUNT's bytes, convert a single .aax file passed in AAXPATH
-// and return the path of the created .m4b file.
-func (c *Client) ConvertSingleBook(account string, aaxpath string) string {
-	account, err := c.NeedAccount(account)
-	unwrap(err)
-	a := c.FindAccount(account)
-	var m4bpath string
-	if aaxpath[len(aaxpath)-4:] == ".aax" {
-		m4bpath = aaxpath[:len(aaxpath)-4] + ".m4b"
+// and return the path of the created .m4b file along with the name of
+// the account whose bytes were used.  If ACCOUNT is empty and there
+// are several accounts, use whichever one's bytes unlock the file.  If
+// ffmpeg fails its output is printed to stderr.
+func (c *Client) ConvertSingleBook(account string, aaxpath string) (string, string, error) {
+	var a *Account
+	if account == "" && len(c.Accounts) > 1 {
+		var err error
+		if a, err = c.findAccountForAAX(aaxpath); err != nil {
+			return "", "", err
+		}
 	} else {
-		m4bpath = aaxpath + ".m4b"
+		account, err := c.NeedAccount(account)
+		if err != nil {
+			return "", "", err
+		}
+		a = c.FindAccount(account)
 	}
-	err, ffmpegstderr := a.Convert(aaxpath, m4bpath, c)
+	m4b, err := c.convertWithPrinting(a, aaxpath, filepath.Base(aaxpath))
+	return m4b, a.Name, err
+}
+
+// Convert the .aax file in AAXPATH with A's bytes while displaying the
+// percentage done and an estimate of the time left, calling it NAME.
+// Return the path of the created .m4b file.
+func (c *Client) convertWithPrinting(a *Account, aaxpath, name string) (string, error) {
+	m4bpath := m4bPath(aaxpath)
+
+	var wg sync.WaitGroup
+	ch := make(chan float64)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		start := time.Now()
+		fmt.Printf("%s%s %s...", clearline, bold("Converting Book"), name)
+		for frac := range ch {
+			if frac <= 0 {
+				continue
+			}
+			elapsed := time.Since(start)
+			eta := time.Duration(float64(elapsed)/frac) - elapsed
+			fmt.Printf("%s%s %s...%d%% (%s left)", clearline,
+				bold("Converting Book"), name, int(frac*100),
+				eta.Round(time.Second))
+		}
+		fmt.Printf("%s%s %s...", clearline, bold("Converting Book"), name)
+	}()
+	err, ffmpegstderr := a.Convert(aaxpath, m4bpath, c, ch)
+	wg.Wait()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", ffmpegstderr)
-		log.Fatalf("Failed to convert %s with bytes %s\n",
-			filepath.Base(aaxpath), a.Bytes)
+		fmt.Printf("failed\n")
+		if c.ctx.Err() != nil {
+			return "", fmt.Errorf("Interrupted while converting %s",
+				filepath.Base(aaxpath))
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", a.Redact(string(ffmpegstderr)))
+		return "", fmt.Errorf("Failed to convert %s with the bytes for %s",
+			filepath.Base(aaxpath), a.Name)
 	}
-	return m4bpath
+	fmt.Printf("done\n")
+	return m4bpath, nil
 }
 
-// For each account, load the cached cookies into memory.
+// For each account, load the cached cookies into memory, or fetch
+// them from its cookies_command if it has one.
 func (c *Client) GetCookies() {
 	for i := 0; i < len(c.Accounts); i++ {
 		a := &c.Accounts[i]
 		if !a.Scrape {
 			continue
 		}
-		path := c.DataDir + a.Name + ".cookies.json"
-		raw, err := os.ReadFile(path)
+		var raw []byte
+		var err error
+		if a.CookiesCommand != "" {
+			raw, err = runSecretCommand(a.CookiesCommand)
+			expect(err, "cookies_command failed for account "+a.Name)
+			a.Auth, err = parseCookies("the output of cookies_command", raw)
+			expect(err, "Unknown json in cookies for account "+a.Name)
+			continue
+		}
+		path := c.cookiesPath(a.Name)
+		raw, err = c.readSecretFile(path)
 		expect(err, "Couldn't find any cookies for account "+a.Name)
-		expect(json.Unmarshal(raw, &a.Auth),
+		write := func(up []byte) error {
+			return writeFileAtomic(path, up, filePerm(path))
+		}
+		if _, err = os.Stat(path); os.IsNotExist(err) {
+			// Keep cookies locked with "secrets lock" encrypted
+			path += secretSuffix
+			write = func(up []byte) error {
+				c.writeSealed(path, up)
+				return nil
+			}
+		}
+		raw, err = upgradeState(stateCookies, path, raw, write)
+		unwrap(err)
+		var f cookieFile
+		expect(json.Unmarshal(raw, &f),
 			"Unknown json in cookie file for account "+a.Name)
+		a.Auth = f.Cookies
 	}
 }
 
 // Populate client's hash table of previously downloaded books from a
 // json file.
 func (c *Client) GetDownloaded() {
-	var books []Book
+	var store bookStore
 	path := c.DataDir + "downloaded_books.json"
 	raw, err := os.ReadFile(path)
 	if err != nil {
@@ -182,8 +341,9 @@ func (c *Client) GetDownloaded() {
 		}
 		return
 	}
-	expect(json.Unmarshal(raw, &books), "Bad json in downloaded book file")
-	for _, b := range books {
+	raw = mustUpgradeState(stateDownloaded, path, raw)
+	expect(json.Unmarshal(raw, &store), "Bad json in downloaded book file")
+	for _, b := range store.Books {
 		c.Downloaded[b.Title] = b
 	}
 }
@@ -191,19 +351,43 @@ func (c *Client) GetDownloaded() {
 // Write the map of downloaded books off to the file, overwriting its
 // old contents
 func (c *Client) SetDownloaded() {
-	var books []Book
+	store := bookStore{Version: currentVersion(stateDownloaded)}
 	for _, b := range c.Downloaded {
-		books = append(books, b)
+		store.Books = append(store.Books, b)
 	}
-	json, _ := json.MarshalIndent(books, "", "  ")
-	unwrap(ioutil.WriteFile(c.DataDir+"downloaded_books.json", json, 0644))
+	json, _ := json.MarshalIndent(store, "", "  ")
+	unwrap(c.writeStore(c.DataDir+"downloaded_books.json", json))
+}
+
+// The possible outcomes of processing a single book.
+const (
+	BookSkipped   = "skipped"
+	BookConverted = "converted"
+	BookFailed    = "failed"
+)
+
+// ScrapeLibrary records what happened to each book in one of these so
+// that a single bad book doesn't abort the whole run.  Downloaded is
+// set once the .aax is on disk, even if the book failed afterwards.
+// Failures that aren't specific to a book, like the scraper breaking,
+// have an empty Title.  See errorClass() for Class.
+type BookResult struct {
+	Account    string
+	Title      string
+	Status     string
+	Class      string
+	Reason     string
+	Downloaded bool
 }
 
 // This function orchestrates the scraping, downloading, and
 // conversion of audiobooks for all configured acounts or the one
 // passed in ACCOUNT.  It also displays a progress report in stdout.
-func (c *Client) ScrapeLibrary(account string) {
+// Failures are recorded and processing continues with the next book.
+// Books which have failed too many times are skipped.
+func (c *Client) ScrapeLibrary(account string) []BookResult {
 	var toscrape []Account
+	var results []BookResult
 	if a := c.FindAccount(account); a != nil {
 		toscrape = append(toscrape, *a)
 		if !a.Scrape {
@@ -214,28 +398,189 @@ func (c *Client) ScrapeLibrary(account string) {
 		toscrape = c.Accounts
 	}
 	for _, a := range toscrape {
-		if !a.Scrape {
+		if !a.Scrape || c.ctx.Err() != nil {
+			continue
+		}
+		books, err := c.scrapeLibraryWithPrinting(&a)
+		if err != nil {
+			results = append(results, BookResult{
+				Account: a.Name,
+				Status:  BookFailed,
+				Reason:  "scraping library: " + err.Error(),
+			})
 			continue
 		}
-		for i := 0; i < len(books); i++ {
+		for i := 0; i < len(books) && c.ctx.Err() == nil; i++ {
 			b := books[i]
-			if _, ok := c.Downloaded[b.Title]; ok {
+			_, done := c.Downloaded[b.Title]
+			if done {
+				c.refreshMetadata(&a, &b)
+			}
+			if done || c.isQuarantined(b.Title) {
+				results = append(results, BookResult{
+					Account: a.Name,
+					Title:   b.Title,
+					Status:  BookSkipped,
+				})
 				continue
 			}
-			fmt.Printf("\033[1mDownloading Book\033[m %s...", b.Title)
-			aax := a.DownloadSingleBook(c, b)
-			fmt.Printf("done\n")
-			fmt.Printf("\033[1mConverting Book\033[m %s...", b.Title)
-			m4b := c.ConvertSingleBook(a.Name, aax)
-			unwrap(os.Rename(m4b, c.SaveDir+b.FileName+".m4b"))
-			fmt.Printf("done\n")
-			c.Downloaded[b.Title] = b
-			c.SetDownloaded()
+			r := c.processBook(&a, &b)
+			c.recordResult(b, r)
+			results = append(results, r)
 		}
 	}
+	return results
 }
 
-func scrapeLibraryWithPrinting(a *Account) []Book {
+// Download and convert a single book B for account A, recording what
+// happened.  B is updated with what we learned while downloading it.
+func (c *Client) processBook(a *Account, b *Book) BookResult {
+	r := BookResult{Account: a.Name, Title: b.Title, Status: BookFailed}
+	aax, ok := c.downloadBook(a, b, &r)
+	if ok {
+		c.convertBook(a, b, aax, &r)
+	}
+	if r.Status == BookFailed && c.ctx.Err() != nil {
+		r.Class = "interrupted"
+		r.Reason = "interrupted"
+	}
+	return r
+}
+
+// The download half of processBook(), returning the path to the .aax
+// file and whether it succeeded.
+func (c *Client) downloadBook(a *Account, b *Book, r *BookResult) (string, bool) {
+	b.Account = a.Name
+	fmt.Printf("\033[1mDownloading Book\033[m %s...", b.Title)
+	aax, err := a.DownloadSingleBook(c, b)
+	if err != nil {
+		fmt.Printf("failed\n")
+		r.Class = errorClass("download", err)
+		r.Reason = "downloading: " + err.Error()
+		return "", false
+	}
+	r.Downloaded = true
+	b.Quality = codecQuality(b.Codec)
+	if b.Codec != c.codecLadder(a)[0] {
+		fmt.Printf("done (as %s)\n", b.Codec)
+	} else {
+		fmt.Printf("done\n")
+	}
+	return aax, true
+}
+
+// The conversion half of processBook(), which also moves the book into
+// SaveDir according to the layout, overwriting any previous version,
+// and records it as downloaded.
+func (c *Client) convertBook(a *Account, b *Book, aax string, r *BookResult) {
+	m4b, err := c.convertWithPrinting(a, aax, b.Title)
+	if err != nil {
+		r.Class = errorClass("convert", err)
+		r.Reason = "converting: " + err.Error()
+		return
+	}
+	if c.Verify {
+		fmt.Printf("\033[1mVerifying Book\033[m %s...", b.Title)
+		if err = c.verifyBook(b, m4b); err != nil {
+			fmt.Printf("failed\n")
+			os.Remove(m4b)
+			r.Class = "verify"
+			r.Reason = "verifying: " + err.Error()
+			return
+		}
+		fmt.Printf("done\n")
+	}
+	// Not having chapters in the store is no reason to fail the book
+	chapters, err := probeChapters(m4b, "")
+	if err != nil {
+		a.Log("Failed to read chapters from %s: %s", b.Title, err)
+	}
+	b.Chapters = c.titleChapters(a, b, m4b, chapters)
+	b.Layout = c.Layout
+	err = os.MkdirAll(c.bookDir(a, b, b.Layout), 0755)
+	if err == nil && a.keepsM4B() {
+		err = os.Rename(m4b, c.audioPath(a, b, b.Layout))
+	}
+	if err != nil {
+		r.Class = errorClass("convert", err)
+		r.Reason = "converting: " + err.Error()
+		return
+	}
+	if !a.keepsM4B() {
+		fmt.Printf("\033[1mWriting Book\033[m %s...", b.Title)
+		err = c.finishBook(a, b, m4b)
+		if err != nil {
+			fmt.Printf("failed\n")
+			r.Class = "output"
+			r.Reason = "writing output: " + err.Error()
+			return
+		}
+		fmt.Printf("done\n")
+	}
+	if err = c.writeSidecars(a, b, b); err != nil {
+		a.Log("Failed to write sidecars for %s: %s", b.Title, err)
+	}
+	b.Files = c.findBookFiles(a, b, b.Layout)
+	c.hashFiles(b)
+	c.Downloaded[b.Title] = *b
+	c.SetDownloaded()
+	c.writeManifests(b)
+	r.Status = BookConverted
+}
+
+// Print a table summarizing RESULTS for each account followed by the
+// reason each failed book failed.  Returns true if anything failed.
+func PrintSummary(results []BookResult) bool {
+	type counts struct{ downloaded, converted, skipped, failed int }
+	var order []string
+	tally := make(map[string]*counts)
+	var failed []BookResult
+	for _, r := range results {
+		t, ok := tally[r.Account]
+		if !ok {
+			t = &counts{}
+			tally[r.Account] = t
+			order = append(order, r.Account)
+		}
+		if r.Downloaded {
+			t.downloaded++
+		}
+		switch r.Status {
+		case BookSkipped:
+			t.skipped++
+		case BookConverted:
+			t.converted++
+		case BookFailed:
+			t.failed++
+			failed = append(failed, r)
+		}
+	}
+	if len(order) == 0 {
+		return false
+	}
+	fmt.Printf("\n%s\n", bold("Summary"))
+	fmt.Printf("%-20s %10s %10s %10s %10s\n", "Account",
+		"Downloaded", "Converted", "Skipped", "Failed")
+	for _, name := range order {
+		t := tally[name]
+		fmt.Printf("%-20s %10d %10d %10d %10d\n", name,
+			t.downloaded, t.converted, t.skipped, t.failed)
+	}
+	for _, r := range failed {
+		title := r.Title
+		if title == "" {
+			title = "(library)"
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s: %s\n", r.Account, title,
+			r.Reason)
+	}
+	return len(failed) > 0
+}
+
+// Scrape A's library while displaying a progress report.  If the
+// scraper fails, print and save its log so it can be included in a
+// bug report.
+func (c *Client) scrapeLibraryWithPrinting(a *Account) ([]Book, error) {
 	var wg sync.WaitGroup
 	ch := make(chan int)
 	wg.Add(1)
@@ -256,8 +601,14 @@ func scrapeLibraryWithPrinting(a *Account) []Book {
 		fmt.Fprintf(os.Stderr, "BEGIN SCRAPER LOG\n")
 		a.PrintScraperDebuggingInfo()
 		fmt.Fprintf(os.Stderr, "END SCRAPER LOG\n")
+		ioutil.WriteFile(c.DataDir+scraperLogFile, a.LogBuf.Bytes(), 0644)
+		if a.failedPage != nil {
+			ioutil.WriteFile(c.DataDir+failedPageFile, a.failedPage,
+				0644)
+		}
 		log.Println(err)
-		fmt.Fprintf(os.Stderr, debugScraperMessage, a.Name, a.Name)
+		fmt.Fprintf(os.Stderr, debugScraperMessage, a.Name, a.Name,
+			c.DataDir+failedPageFile)
 	}
-	return books
+	return books, err
 }
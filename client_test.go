@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+// Stands in for a real converter, copying the input to the output
+// unless it's told to fail.
+type fakeConverter struct {
+	fail bool
+}
+
+func (f fakeConverter) Convert(ctx context.Context, in, out, bytes string, progress chan<- float64) ([]byte, error) {
+	defer close(progress)
+	if f.fail {
+		return []byte("ffmpeg's complaint"), errors.New("exit status 1")
+	}
+	progress <- 0.5
+	raw, err := os.ReadFile(in)
+	if err != nil {
+		return nil, err
+	}
+	return nil, os.WriteFile(out, raw, 0644)
+}
+
+// Return a client saving into a temporary directory which converts
+// books with CONV.
+func testClient(t *testing.T, conv Converter) *Client {
+	dir := t.TempDir() + "/"
+	c := &Client{
+		SaveDir:    dir,
+		TempDir:    dir + ".audible-dl/temp/",
+		DataDir:    dir + ".audible-dl/",
+		Accounts:   []Account{{Name: "test", Bytes: testActivation}},
+		Downloaded: make(map[string]Book),
+		Failed:     make(map[string]FailedBook),
+		ctx:        context.Background(),
+		conv:       conv,
+	}
+	if err := os.MkdirAll(c.TempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestConvertBook(t *testing.T) {
+	c := testClient(t, fakeConverter{})
+	a := &c.Accounts[0]
+	b := &Book{Title: "A Book", FileName: "A_Book"}
+	aax := c.TempDir + "A_Book.aax"
+	if err := os.WriteFile(aax, []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := BookResult{Status: BookFailed}
+	c.convertBook(a, b, aax, &r)
+	if r.Status != BookConverted {
+		t.Fatalf("convertBook() failed: %s", r.Reason)
+	}
+	raw, err := os.ReadFile(c.SaveDir + "A_Book.m4b")
+	if err != nil || string(raw) != "audio" {
+		t.Errorf("book wasn't saved: %q, %v", raw, err)
+	}
+	saved, ok := c.Downloaded[b.Title]
+	if !ok {
+		t.Fatal("book wasn't recorded as downloaded")
+	}
+	if len(saved.Files) != 1 || saved.Files[0].Path != "A_Book.m4b" ||
+		saved.Files[0].SHA256 == "" {
+		t.Errorf("recorded files = %+v", saved.Files)
+	}
+	if _, err = os.Stat(c.DataDir + "downloaded_books.json"); err != nil {
+		t.Errorf("store wasn't written: %s", err)
+	}
+}
+
+func TestConvertBookFailure(t *testing.T) {
+	c := testClient(t, fakeConverter{fail: true})
+	a := &c.Accounts[0]
+	b := &Book{Title: "A Book", FileName: "A_Book"}
+	r := BookResult{Status: BookFailed}
+	c.convertBook(a, b, c.TempDir+"A_Book.aax", &r)
+	if r.Status != BookFailed || r.Reason == "" {
+		t.Errorf("convertBook() = %+v, want a failure", r)
+	}
+	if _, ok := c.Downloaded[b.Title]; ok {
+		t.Errorf("failed book was recorded as downloaded")
+	}
+	if _, err := os.Stat(c.SaveDir + "A_Book.m4b"); err == nil {
+		t.Errorf("failed book was saved")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+////////////////////////////////////////////////////////////////////////
+//                                   _
+//   ___ ___  _ ____   _____ _ __| |_ ___ _ __ ___
+//  / __/ _ \| '_ \ \ / / _ \ '__| __/ _ \ '__/ __|
+// | (_| (_) | | | \ V /  __/ |  | ||  __/ |  \__ \
+//  \___\___/|_| |_|\_/ \___|_|   \__\___|_|  |___/
+////////////////////////////////////////////////////////////////////////
+
+// A Converter strips the DRM from an .aax file.  Convert() decrypts
+// the .aax file in IN into the .m4b file in OUT using the hex-encoded
+// activation BYTES, sending the fraction of the work done so far to
+// PROGRESS, which it closes when it returns.  It gives up when CTX is
+// cancelled.  On failure it returns whatever diagnostic output the
+// backend produced along with the error.
+type Converter interface {
+	Convert(ctx context.Context, in, out, bytes string,
+		progress chan<- float64) ([]byte, error)
+}
+
+// Shells out to ffmpeg, the default.
+type FFmpegConverter struct{}
+
+// Decrypts the file in Go, see aax.go.  This doesn't need ffmpeg but
+// it doesn't check the audio for errors either.
+type NativeConverter struct{}
+
+// Runs an arbitrary shell command, which finds the input and output
+// paths and the activation bytes in the environment variables
+// AUDIBLE_DL_INPUT, AUDIBLE_DL_OUTPUT, and AUDIBLE_DL_BYTES.
+type CommandConverter struct {
+	Command string
+}
+
+// Ffmpeg prints the input's duration to stderr in this format.
+var ffmpegDurationRegexp = regexp.MustCompile(
+	`Duration: (\d+):(\d+):(\d+(\.\d+)?)`)
+
+// Run ffmpeg with its machine readable progress output on stdout,
+// which reports how much of the output it has written, and work out
+// how far along it is using the duration it prints to stderr.
+func (FFmpegConverter) Convert(ctx context.Context, in, out, bytes string, progress chan<- float64) ([]byte, error) {
+	defer close(progress)
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-nostats", "-progress", "pipe:1",
+		"-activation_bytes", bytes,
+		"-i", in,
+		"-c", "copy",
+		out)
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read stderr a line at a time so that the duration in ffmpeg's
+	// header is known as soon as it's printed
+	var mu sync.Mutex
+	var total float64
+	var slurp []byte
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lines := bufio.NewScanner(stderr)
+		for lines.Scan() {
+			mu.Lock()
+			slurp = append(slurp, lines.Bytes()...)
+			slurp = append(slurp, '\n')
+			if total == 0 {
+				total = ffmpegDuration(lines.Bytes())
+			}
+			mu.Unlock()
+		}
+		// Don't leave ffmpeg blocked on a line too long to scan
+		io.Copy(io.Discard, stderr)
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, val, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != "out_time_us" && key != "out_time_ms" {
+			continue
+		}
+		// Both are actually in microseconds
+		us, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			continue
+		}
+		mu.Lock()
+		t := total
+		mu.Unlock()
+		if t > 0 {
+			progress <- us / 1e6 / t
+		}
+	}
+	<-done
+	if err = cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return slurp, ctx.Err()
+		}
+		return slurp, err
+	}
+	return nil, nil
+}
+
+// Return the duration in seconds of ffmpeg's input if LINE of its
+// stderr is the one it's printed on, otherwise 0.
+func ffmpegDuration(line []byte) float64 {
+	m := ffmpegDurationRegexp.FindSubmatch(line)
+	if m == nil {
+		return 0
+	}
+	h, _ := strconv.ParseFloat(string(m[1]), 64)
+	min, _ := strconv.ParseFloat(string(m[2]), 64)
+	sec, _ := strconv.ParseFloat(string(m[3]), 64)
+	return h*3600 + min*60 + sec
+}
+
+func (NativeConverter) Convert(ctx context.Context, in, out, bytes string, progress chan<- float64) ([]byte, error) {
+	defer close(progress)
+	if err := decryptAAX(ctx, in, out, bytes, progress); err != nil {
+		os.Remove(out)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// The command's progress is unknown, so we don't report any.
+func (c CommandConverter) Convert(ctx context.Context, in, out, bytes string, progress chan<- float64) ([]byte, error) {
+	defer close(progress)
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.Command)
+	cmd.Env = append(os.Environ(),
+		"AUDIBLE_DL_INPUT="+in,
+		"AUDIBLE_DL_OUTPUT="+out,
+		"AUDIBLE_DL_BYTES="+bytes)
+	slurp, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return slurp, ctx.Err()
+	}
+	if err != nil {
+		return slurp, err
+	}
+	if _, err = os.Stat(out); err != nil {
+		return slurp, errors.New("converter command didn't create " +
+			out)
+	}
+	return nil, nil
+}
+
+// Return the converter selected in the config file.
+func (c *Client) converter() (Converter, error) {
+	if c.conv != nil {
+		return c.conv, nil
+	}
+	switch c.Converter {
+	case "", "ffmpeg":
+		return FFmpegConverter{}, nil
+	case "native":
+		return NativeConverter{}, nil
+	case "command":
+		if c.ConverterCommand == "" {
+			return nil, errors.New("converter is `command' but " +
+				"converter_command isn't set")
+		}
+		return CommandConverter{c.ConverterCommand}, nil
+	}
+	return nil, errors.New("Unknown converter " + c.Converter)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////
+//   __       _ _          _   _                 _
+//  / _| __ _(_) | ___  __| | | |__   ___   ___ | | _____
+// | |_ / _` | | |/ _ \/ _` | | '_ \ / _ \ / _ \| |/ / __|
+// |  _| (_| | | |  __/ (_| | | |_) | (_) | (_) |   <\__ \
+// |_|  \__,_|_|_|\___|\__,_| |_.__/ \___/ \___/|_|\_\___/
+////////////////////////////////////////////////////////////////////////
+
+// Books which have failed this many times are quarantined and no
+// longer retried unless the config file says otherwise.
+const defaultMaxAttempts int = 3
+
+// Every book which fails to download or convert is recorded in one of
+// these, which are kept in DataDir until the book succeeds.  Class is
+// a short machine-friendly description of the failure, like
+// "forbidden" or "convert", while Reason is the full error message.
+type FailedBook struct {
+	Book        Book
+	Account     string
+	Class       string
+	Reason      string
+	Attempts    int
+	FirstFailed time.Time
+	LastFailed  time.Time
+	Quarantined bool
+}
+
+// Return the number of attempts after which a book is quarantined.
+func (c *Client) maxAttempts() int {
+	if c.MaxAttempts > 0 {
+		return c.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
+
+// Populate the client's hash table of failed books from a json file.
+func (c *Client) GetFailed() {
+	var store failedStore
+	path := c.DataDir + "failed_books.json"
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		// It's okay for the file not to exist
+		if !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		return
+	}
+	raw = mustUpgradeState(stateFailed, path, raw)
+	expect(json.Unmarshal(raw, &store), "Bad json in failed book file")
+	for _, f := range store.Books {
+		c.Failed[f.Book.Title] = f
+	}
+}
+
+// Write the map of failed books off to the file, overwriting its old
+// contents.
+func (c *Client) SetFailed() {
+	store := failedStore{Version: currentVersion(stateFailed)}
+	for _, f := range c.Failed {
+		store.Books = append(store.Books, f)
+	}
+	json, _ := json.MarshalIndent(store, "", "  ")
+	unwrap(c.writeStore(c.DataDir+"failed_books.json", json))
+}
+
+// Update the failed book store with the outcome R of processing B,
+// incrementing its attempt count and quarantining it if it's failed
+// too many times, or forgetting about it if it succeeded.
+func (c *Client) recordResult(b Book, r BookResult) {
+	switch r.Status {
+	case BookConverted:
+		if _, ok := c.Failed[b.Title]; ok {
+			delete(c.Failed, b.Title)
+			c.SetFailed()
+		}
+	case BookFailed:
+		// Being interrupted by the user isn't the book's fault
+		if r.Class == "interrupted" {
+			return
+		}
+		now := time.Now()
+		f := c.Failed[b.Title]
+		if f.FirstFailed.IsZero() {
+			f.FirstFailed = now
+		}
+		f.Book = b
+		f.Account = r.Account
+		f.Class = r.Class
+		f.Reason = r.Reason
+		f.Attempts++
+		f.LastFailed = now
+		f.Quarantined = f.Attempts >= c.maxAttempts()
+		c.Failed[b.Title] = f
+		c.SetFailed()
+	}
+}
+
+// Determine whether the book titled TITLE has been quarantined.
+func (c *Client) isQuarantined(title string) bool {
+	f, ok := c.Failed[title]
+	return ok && f.Quarantined
+}
+
+// Classify an error ERR which occured during STAGE ("download" or
+// "convert") so that similar failures can be grouped together.
+func errorClass(stage string, err error) string {
+	var refused *refusedError
+	var truncated *truncatedError
+	switch {
+	case errors.As(err, &truncated):
+		return "truncated"
+	case errors.As(err, &refused) && refused.Status == http.StatusForbidden:
+		return "forbidden"
+	case errors.As(err, &refused) && refused.Status == http.StatusNotFound:
+		return "not-found"
+	}
+	return stage
+}
+
+// Try again to download and convert every book in the failed book
+// store belonging to ACCOUNT, or to any account if it's empty,
+// skipping those that have been quarantined.  Unlike ScrapeLibrary()
+// this doesn't need to scrape anything since the store has everything
+// we need to know about the book.
+func (c *Client) RetryFailed(account string) []BookResult {
+	var results []BookResult
+	for _, f := range c.Failed {
+		if c.ctx.Err() != nil {
+			break
+		}
+		if account != "" && f.Account != account {
+			continue
+		}
+		if f.Quarantined {
+			results = append(results, BookResult{
+				Account: f.Account,
+				Title:   f.Book.Title,
+				Status:  BookSkipped,
+			})
+			continue
+		}
+		a := c.FindAccount(f.Account)
+		if a == nil {
+			log.Printf("Account %s no longer exists, skipping %s",
+				f.Account, f.Book.Title)
+			continue
+		}
+		r := c.processBook(a, &f.Book)
+		c.recordResult(f.Book, r)
+		results = append(results, r)
+	}
+	return results
+}
+
+// Print a list of every quarantined book along with why it failed.
+func (c *Client) ListQuarantined() {
+	n := 0
+	for _, f := range c.Failed {
+		if !f.Quarantined {
+			continue
+		}
+		n++
+		fmt.Printf("%s: %s\n", f.Account, bold(f.Book.Title))
+		fmt.Printf("  ASIN:     %s\n", f.Book.Slug)
+		fmt.Printf("  Class:    %s\n", f.Class)
+		fmt.Printf("  Reason:   %s\n", f.Reason)
+		fmt.Printf("  Attempts: %d (first %s, last %s)\n", f.Attempts,
+			f.FirstFailed.Format(time.RFC3339),
+			f.LastFailed.Format(time.RFC3339))
+	}
+	if n == 0 {
+		fmt.Println("No books are quarantined.")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		// The byte counts of a truncated download mustn't be taken
+		// for a status code
+		{&truncatedError{14036, 90000}, "truncated"},
+		{&refusedError{403, []string{"AAX: 403 Forbidden"}}, "forbidden"},
+		{&refusedError{404, []string{"AAX: 404 Not Found"}}, "not-found"},
+		{fmt.Errorf("wrapped: %w", &refusedError{Status: 403}), "forbidden"},
+		{&refusedError{500, []string{"AAX: 500 Internal Server Error"}},
+			"download"},
+		{errors.New("ffmpeg exited with status 403"), "download"},
+	}
+	for _, tt := range tests {
+		if got := errorClass("download", tt.err); got != tt.want {
+			t.Errorf("errorClass(%q) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////
+//  _                            _
+// (_)_ __ ___  _ __   ___  _ __| |_
+// | | '_ ` _ \| '_ \ / _ \| '__| __|
+// | | | | | | | |_) | (_) | |  | |_
+// |_|_| |_| |_| .__/ \___/|_|   \__|
+//             |_|
+////////////////////////////////////////////////////////////////////////
+
+// Matches scoring at least this are recorded without asking, and those
+// scoring less than reviewScore aren't considered matches at all.
+const (
+	acceptScore float64 = 0.85
+	reviewScore float64 = 0.5
+)
+
+// When there's nowhere better to put the matches that need reviewing
+// they're written to this file in DataDir.
+const importReviewFile string = "import-review.json"
+
+// The extensions of the audio files import-existing looks at.
+var importExts = []string{".m4b", ".m4a", ".mp3"}
+
+// A book someone else archived, made up of one or more audio files.
+// The tags are those of its first file, and Duration is the total.
+type existingBook struct {
+	Files    []string
+	Title    string
+	Album    string
+	Artist   string
+	ASIN     string
+	Duration float64
+}
+
+// A book in someone's Audible library.
+type libraryBook struct {
+	Account string
+	Book    Book
+}
+
+// A guess at which library book an existing book is.  These are what
+// go in the review file, where Accept can be set by hand.
+type importMatch struct {
+	Accept  bool
+	Score   float64
+	Reason  string
+	Files   []string
+	Account string
+	Book    Book
+}
+
+// Implement the import-existing subcommand, which adds books archived
+// by other tools in DIR to the downloaded book store so that they
+// aren't downloaded again.  Each is matched against the libraries of
+// ACCOUNT, or every account if it's empty.  Confident matches are
+// recorded straight away; the rest are asked about if stdin is a
+// terminal, or otherwise written to a review file to be edited and
+// passed back with --accept.
+func (c *Client) ImportExistingCommand(account string, argv []string) {
+	flags := flag.NewFlagSet("import-existing", flag.ExitOnError)
+	review := flags.String("review", "", "")
+	accept := flags.String("accept", "", "")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: audible-dl import-existing "+
+			"[--review FILE] DIR\n"+
+			"       audible-dl import-existing --accept FILE\n")
+	}
+	flags.Parse(argv)
+
+	if *accept != "" {
+		if flags.NArg() != 0 {
+			flags.Usage()
+			os.Exit(1)
+		}
+		raw, err := os.ReadFile(*accept)
+		unwrap(err)
+		raw, err = upgradeState(stateReview, *accept, raw, nil)
+		unwrap(err)
+		var review reviewFile
+		expect(json.Unmarshal(raw, &review), "Bad json in "+*accept)
+		n := 0
+		for _, m := range review.Matches {
+			if m.Accept && c.recordImport(m) {
+				n++
+			}
+		}
+		fmt.Printf("Imported %d books\n", n)
+		return
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	books, err := c.scanExisting(flags.Arg(0))
+	unwrap(err)
+	if len(books) == 0 {
+		fmt.Println("Didn't find any audiobooks that aren't already " +
+			"recorded")
+		return
+	}
+	c.GetCookies()
+	library := c.scrapeLibraries(account)
+
+	var unsure []importMatch
+	imported, unmatched := 0, 0
+	for _, eb := range books {
+		m := matchExisting(eb, library, c.verifyTolerance())
+		switch {
+		case m.Score >= acceptScore:
+			if c.recordImport(m) {
+				imported++
+			}
+		case m.Score >= reviewScore:
+			unsure = append(unsure, m)
+		default:
+			unmatched++
+			fmt.Printf("%s %s\n", bold("No match for"), eb.Files[0])
+		}
+	}
+
+	if len(unsure) > 0 && *review == "" && isTerminal() {
+		for _, m := range unsure {
+			if askImport(m) && c.recordImport(m) {
+				imported++
+			}
+		}
+		unsure = nil
+	}
+	if len(unsure) > 0 {
+		path := *review
+		if path == "" {
+			path = c.DataDir + importReviewFile
+		}
+		raw, _ := json.MarshalIndent(reviewFile{
+			Version: currentVersion(stateReview),
+			Matches: unsure,
+		}, "", "  ")
+		unwrap(os.WriteFile(path, raw, 0644))
+		fmt.Printf("Set Accept to true for the correct matches in %s "+
+			"and run\n  audible-dl import-existing --accept %s\n",
+			path, path)
+	}
+	fmt.Printf("Imported %d books, %d to review, %d unmatched\n",
+		imported, len(unsure), unmatched)
+}
+
+// Find every audiobook in DIR which isn't already in the store.  The
+// parts of books split into several files are recognized by sharing a
+// directory and album tag.
+func (c *Client) scanExisting(dir string) ([]existingBook, error) {
+	known := make(map[string]bool)
+	for _, b := range c.Downloaded {
+		for _, f := range b.Files {
+			abs, _ := filepath.Abs(c.absPath(f.Path))
+			known[abs] = true
+		}
+	}
+	var books []existingBook
+	parts := make(map[string]int)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		wanted := false
+		for _, e := range importExts {
+			wanted = wanted || ext == e
+		}
+		if abs, _ := filepath.Abs(path); !wanted || known[abs] {
+			return nil
+		}
+		eb, err := probeExisting(path)
+		if err != nil {
+			log.Printf("Skipping %s: %s", path, err)
+			return nil
+		}
+		key := filepath.Dir(path) + "\x00" + eb.Album
+		if i, ok := parts[key]; ok && eb.Album != "" && ext != ".m4b" {
+			books[i].Files = append(books[i].Files, eb.Files...)
+			books[i].Duration += eb.Duration
+			return nil
+		}
+		parts[key] = len(books)
+		books = append(books, eb)
+		return nil
+	})
+	return books, err
+}
+
+// Read the tags and duration of the audio file in PATH with ffprobe.
+func probeExisting(path string) (existingBook, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return existingBook{}, err
+	}
+	out, err := exec.Command("ffprobe", "-v", "quiet", "-print_format",
+		"json", "-show_format", path).Output()
+	if err != nil {
+		return existingBook{}, err
+	}
+	var probe struct {
+		Format struct {
+			Duration string            `json:"duration"`
+			Tags     map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err = json.Unmarshal(out, &probe); err != nil {
+		return existingBook{}, err
+	}
+	tags := make(map[string]string)
+	for k, v := range probe.Format.Tags {
+		tags[strings.ToLower(k)] = v
+	}
+	eb := existingBook{
+		Files:  []string{abs},
+		Title:  tags["title"],
+		Album:  tags["album"],
+		Artist: tags["artist"] + " " + tags["album_artist"],
+		ASIN:   tags["asin"],
+	}
+	if eb.ASIN == "" {
+		eb.ASIN = tags["audible_asin"]
+	}
+	eb.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	return eb, nil
+}
+
+// Scrape the library of ACCOUNT, or of every account that's scraped
+// if it's empty.
+func (c *Client) scrapeLibraries(account string) []libraryBook {
+	var library []libraryBook
+	for i := range c.Accounts {
+		a := &c.Accounts[i]
+		if account != "" && a.Name != account || !a.Scrape {
+			continue
+		}
+		books, err := c.scrapeLibraryWithPrinting(a)
+		if err != nil {
+			log.Fatalf("Failed to scrape the library of %s", a.Name)
+		}
+		for _, b := range books {
+			library = append(library, libraryBook{a.Name, b})
+		}
+	}
+	return library
+}
+
+// Return the book in LIBRARY most likely to be EB.  A matching ASIN
+// tag settles it; otherwise the score is mostly down to how similar
+// the titles are, with the rest down to whether the author appears in
+// the artist tags and whether the durations agree to within TOLERANCE
+// minutes.  Books with nothing to go on score half for that part.
+func matchExisting(eb existingBook, library []libraryBook, tolerance int) importMatch {
+	var best importMatch
+	best.Files = eb.Files
+	stem := strings.TrimSuffix(filepath.Base(eb.Files[0]),
+		filepath.Ext(eb.Files[0]))
+	for _, lb := range library {
+		if eb.ASIN != "" && eb.ASIN == lb.Book.Slug {
+			return importMatch{Score: 1, Reason: "ASIN tag",
+				Files: eb.Files, Account: lb.Account, Book: lb.Book}
+		}
+		title := 0.0
+		for _, t := range []string{eb.Album, eb.Title, stem} {
+			title = math.Max(title, similarity(t, lb.Book.Title))
+		}
+		author := 0.5
+		if strings.TrimSpace(eb.Artist) != "" {
+			author = 0
+			for _, a := range lb.Book.Authors {
+				if similarity(a, eb.Artist) > 0 &&
+					containsWords(eb.Artist, a) {
+					author = 1
+				}
+			}
+		}
+		runtime := 0.5
+		if want := parseRuntime(lb.Book.Runtime); want > 0 && eb.Duration > 0 {
+			diff := math.Abs(eb.Duration - want)
+			runtime = 0
+			if diff <= float64(tolerance*60) {
+				runtime = 1
+			} else if eb.Duration > want {
+				// Started books show the time remaining
+				runtime = 0.5
+			}
+		}
+		score := 0.6*title + 0.2*author + 0.2*runtime
+		if score > best.Score {
+			best = importMatch{Score: score, Files: eb.Files,
+				Account: lb.Account, Book: lb.Book,
+				Reason: fmt.Sprintf("title %.2f, author %.1f, "+
+					"runtime %.1f", title, author, runtime)}
+		}
+	}
+	return best
+}
+
+// Matches everything but letters, digits, and spaces.
+var punctuationRegexp = regexp.MustCompile(`[^\p{L}\p{N} ]+`)
+
+// Return the words of S, ignoring case and punctuation.
+func words(s string) []string {
+	return strings.Fields(punctuationRegexp.ReplaceAllString(
+		strings.ToLower(s), " "))
+}
+
+// Return the Jaccard similarity of the words of A and B, from 0 when
+// they have none in common to 1 when they have the same words.
+func similarity(a, b string) float64 {
+	wa, wb := make(map[string]bool), make(map[string]bool)
+	for _, w := range words(a) {
+		wa[w] = true
+	}
+	for _, w := range words(b) {
+		wb[w] = true
+	}
+	common := 0
+	for w := range wa {
+		if wb[w] {
+			common++
+		}
+	}
+	union := len(wa) + len(wb) - common
+	if union == 0 {
+		return 0
+	}
+	return float64(common) / float64(union)
+}
+
+// Whether every word of NEEDLE appears in HAYSTACK.
+func containsWords(haystack, needle string) bool {
+	have := make(map[string]bool)
+	for _, w := range words(haystack) {
+		have[w] = true
+	}
+	for _, w := range words(needle) {
+		if !have[w] {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether stdin is a terminal someone can answer questions on.
+func isTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Ask whether M is right.
+func askImport(m importMatch) bool {
+	fmt.Printf("\n%s\n", strings.Join(m.Files, "\n"))
+	fmt.Printf("looks like %s by %s (%s, %s)\n", bold(m.Book.Title),
+		strings.Join(m.Book.Authors, ", "), m.Account, m.Reason)
+	fmt.Printf("Is it? [y/N] ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(line)), "y")
+}
+
+// Record the book in M as downloaded, with its files where they are.
+// Returns false if it's already been downloaded.
+func (c *Client) recordImport(m importMatch) bool {
+	b := m.Book
+	if _, ok := c.Downloaded[b.Title]; ok {
+		log.Printf("%s has already been downloaded, not importing %s",
+			b.Title, m.Files[0])
+		return false
+	}
+	b.Account = m.Account
+	b.Files = nil
+	sort.Strings(m.Files)
+	for _, path := range m.Files {
+		f, err := c.statBookFile(path)
+		if err != nil {
+			log.Printf("Not importing %s: %s", b.Title, err)
+			return false
+		}
+		b.Files = append(b.Files, f)
+	}
+	c.hashFiles(&b)
+	fmt.Printf("%s %s\n", bold("Imported"), b.Title)
+	c.Downloaded[b.Title] = b
+	c.SetDownloaded()
+	return true
+}
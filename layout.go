@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+////////////////////////////////////////////////////////////////////////
+//  _                         _
+// | | __ _ _   _  ___  _   _| |_
+// | |/ _` | | | |/ _ \| | | | __|
+// | | (_| | |_| | (_) | |_| | |_
+// |_|\__,_|\__, |\___/ \__,_|\__|
+//          |___/
+////////////////////////////////////////////////////////////////////////
+
+// Describes how books are arranged in SaveDir.  Template is a
+// text/template which expands to the path of a book relative to
+// SaveDir, see layoutFields.  If it ends in a slash the book has that
+// directory to itself and its files are named after its title;
+// otherwise the last component names its files, which go in the
+// directory before it.  Name is how Book.Layout refers to it.
+type layout struct {
+	Name     string
+	Template string
+	tmpl     *template.Template
+}
+
+// Every layout preset, set with the config file's layout field.  Flat
+// is the default.  The layout field may also be a template of its own.
+var layouts = []layout{
+	{Name: "flat", Template: "{{.FileName}}"},
+	{Name: "audiobookshelf", Template: "{{.Author}}/{{if .Series}}" +
+		"{{.Series}}/{{if .SeriesIndex}}Book {{.SeriesIndex}} - " +
+		"{{end}}{{end}}{{.Title}}/"},
+	{Name: "plex", Template: "{{.Author}}/{{.Title}}/"},
+}
+
+// What a layout's template can refer to.  Everything is made safe to
+// use as a path component, and falls back to something sensible when
+// Audible doesn't say, except Series, which is empty for books that
+// aren't part of one.  Author is the first author, Authors all of them.
+type layoutFields struct {
+	Title       string
+	FileName    string
+	Author      string
+	Authors     string
+	Narrator    string
+	Series      string
+	SeriesIndex int
+}
+
+// Characters which aren't allowed in file names on at least one of the
+// filesystems people keep their books on.
+var pathReplacer = strings.NewReplacer("/", "-", `\`, "-", ":", " -",
+	"*", "", "?", "", `"`, "'", "<", "", ">", "", "|", "-")
+
+// Return S made safe to use as a single path component, or DEF if
+// nothing is left of it.
+func pathComponent(s, def string) string {
+	s = strings.Trim(pathReplacer.Replace(cleanstr(s)), " .")
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// Return what a layout's template can say about B.
+func newLayoutFields(b *Book) layoutFields {
+	f := layoutFields{
+		Title:       pathComponent(b.Title, b.FileName),
+		FileName:    b.FileName,
+		Author:      "Unknown Author",
+		Authors:     "Unknown Author",
+		Narrator:    "Unknown Narrator",
+		SeriesIndex: b.SeriesIndex,
+	}
+	if len(b.Authors) > 0 {
+		f.Author = pathComponent(b.Authors[0], f.Author)
+		f.Authors = pathComponent(strings.Join(b.Authors, ", "), f.Author)
+	}
+	if len(b.Narrators) > 0 {
+		f.Narrator = pathComponent(b.Narrators[0], f.Narrator)
+	}
+	if b.Series != "" {
+		f.Series = pathComponent(b.Series, "Unknown Series")
+	}
+	return f
+}
+
+// Return the layout called NAME, which defaults to flat, or which is
+// its own template if it has a {{ in it.  Templates are tried out on
+// an example book so that mistakes are caught before any are moved.
+func getLayout(name string) (layout, error) {
+	if name == "" {
+		name = "flat"
+	}
+	l := layout{Name: name, Template: name}
+	if !strings.Contains(name, "{{") {
+		for _, p := range layouts {
+			if p.Name == name {
+				l = p
+			}
+		}
+		if l.Template == name {
+			return layout{}, errors.New("Unknown layout " + name)
+		}
+	}
+	var err error
+	l.tmpl, err = template.New(name).Option("missingkey=error").
+		Parse(l.Template)
+	if err != nil {
+		return layout{}, errors.New("Bad layout template: " + err.Error())
+	}
+	example := &Book{Title: "Title", FileName: "Title",
+		Authors: []string{"Author"}, Series: "Series", SeriesIndex: 1}
+	if err = l.tmpl.Execute(io.Discard, newLayoutFields(example)); err != nil {
+		return layout{}, errors.New("Bad layout template: " + err.Error())
+	}
+	return l, nil
+}
+
+// Expand L's template for book B, returning the directory it goes in
+// relative to SaveDir, with a trailing slash unless it's SaveDir
+// itself, the name its files are given, and whether the directory is
+// its alone.  Empty components are dropped, and the book falls back to
+// its FileName if nothing's left of the name.
+func (l layout) place(b *Book) (string, string, bool) {
+	fields := newLayoutFields(b)
+	var buf strings.Builder
+	// The template was tried out by getLayout()
+	l.tmpl.Execute(&buf, fields)
+	path := buf.String()
+	owns := strings.HasSuffix(path, "/")
+	var parts []string
+	for _, p := range strings.Split(path, "/") {
+		if p = strings.TrimSpace(p); p != "" && p != "." && p != ".." {
+			parts = append(parts, p)
+		}
+	}
+	if owns {
+		if len(parts) == 0 {
+			return "", b.FileName, false
+		}
+		return strings.Join(parts, "/") + "/", fields.Title, true
+	}
+	if len(parts) == 0 {
+		return "", b.FileName, false
+	}
+	dir := strings.Join(parts[:len(parts)-1], "/")
+	if dir != "" {
+		dir += "/"
+	}
+	return dir, parts[len(parts)-1], false
+}
+
+// Return the directory, with a trailing slash, in which book B of
+// account A is saved under the layout called LAYOUT.  Books split
+// into parts need a directory of their own even if the layout doesn't
+// give them one.
+func (c *Client) bookDir(a *Account, b *Book, layout string) string {
+	l, _ := getLayout(layout)
+	dir, stem, owns := l.place(b)
+	if !owns && a.Split != "" {
+		dir += stem + "/"
+	}
+	return c.SaveDir + dir
+}
+
+// Whether book B of account A has a directory to itself under the
+// layout called LAYOUT.
+func ownsDir(a *Account, b *Book, layout string) bool {
+	l, _ := getLayout(layout)
+	_, _, owns := l.place(b)
+	return a.Split != "" || owns
+}
+
+// Return the path of the audio file of book B of account A under the
+// layout called LAYOUT, or of its directory if it's split into parts.
+func (c *Client) audioPath(a *Account, b *Book, layout string) string {
+	dir := c.bookDir(a, b, layout)
+	if a.Split != "" {
+		return strings.TrimSuffix(dir, "/")
+	}
+	f, _ := getOutputFormat(a.Format, a.Bitrate)
+	return dir + bookStem(b, layout) + f.Ext
+}
+
+// Return the name, without an extension, of the files named after book
+// B under the layout called LAYOUT.
+func bookStem(b *Book, layout string) string {
+	l, _ := getLayout(layout)
+	_, stem, _ := l.place(b)
+	return stem
+}
+
+// Return the account which downloaded B.  Books which predate us
+// recording the account are assumed to belong to ACCOUNT, or to the
+// only account if it's empty.
+func (c *Client) bookAccount(b *Book, account string) (*Account, error) {
+	name := b.Account
+	if name == "" {
+		var err error
+		if name, err = c.NeedAccount(account); err != nil {
+			return nil, errors.New("Don't know which account " +
+				"downloaded it: " + err.Error())
+		}
+	}
+	a := c.FindAccount(name)
+	if a == nil {
+		return nil, errors.New("Account " + name + " no longer exists")
+	}
+	return a, nil
+}
+
+// Remove DIR and each of its parents inside SaveDir for as long as
+// they're empty, or hold nothing but a manifest of what used to be
+// there.
+func (c *Client) removeEmptyDirs(dir string) {
+	root := filepath.Clean(c.SaveDir)
+	for dir = filepath.Clean(dir); strings.HasPrefix(dir, root+"/"); dir = filepath.Dir(dir) {
+		entries, _ := os.ReadDir(dir)
+		if len(entries) == 1 && entries[0].Name() == manifestName {
+			os.Remove(filepath.Join(dir, manifestName))
+		}
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// Return SaveDir-relative PATH.  Paths outside SaveDir, which only
+// books imported with import-existing have, are left absolute.
+func (c *Client) relPath(path string) string {
+	return strings.TrimPrefix(path, c.SaveDir)
+}
+
+// Return the absolute path of PATH, as returned by relPath().
+func (c *Client) absPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return c.SaveDir + path
+}
+
+// Find every file belonging to book B of account A as it was saved
+// under the layout called LAYOUT: everything in its directory if it
+// has one to itself, or else everything named after it in the
+// directory it shares.
+// This picks up covers and companion PDFs put next to it too.  The
+// paths are relative to SaveDir.
+func (c *Client) findBookFiles(a *Account, b *Book, layout string) []BookFile {
+	var files []BookFile
+	add := func(path string) {
+		if f, err := c.statBookFile(path); err == nil {
+			files = append(files, f)
+		}
+	}
+	if ownsDir(a, b, layout) {
+		filepath.WalkDir(c.bookDir(a, b, layout),
+			func(path string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() && d.Name() != manifestName {
+					add(path)
+				}
+				return nil
+			})
+		return files
+	}
+	matches, _ := filepath.Glob(c.bookDir(a, b, layout) +
+		globEscape(bookStem(b, layout)) + ".*")
+	for _, m := range matches {
+		add(m)
+	}
+	return files
+}
+
+// Return the files recorded for B, or for books which predate us
+// recording them, those findBookFiles() turns up where its account and
+// layout say it should be, or nothing if its account is unknown.  See
+// bookAccount() for what ACCOUNT means.
+func (c *Client) bookFiles(b *Book, account string) []BookFile {
+	if len(b.Files) > 0 {
+		return b.Files
+	}
+	a, err := c.bookAccount(b, account)
+	if err != nil {
+		return nil
+	}
+	return c.findBookFiles(a, b, b.Layout)
+}
+
+// Return a record of the file in PATH.
+func (c *Client) statBookFile(path string) (BookFile, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return BookFile{}, err
+	}
+	return BookFile{Path: c.relPath(path), Size: fi.Size()}, nil
+}
+
+// Record F as one of B's files, replacing any record of the same path.
+func (b *Book) setFile(f BookFile) {
+	for i := range b.Files {
+		if b.Files[i].Path == f.Path {
+			b.Files[i] = f
+			return
+		}
+	}
+	b.Files = append(b.Files, f)
+}
+
+// Return S with the characters filepath.Glob() treats specially
+// escaped.
+func globEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`,
+		"[", `\[`).Replace(s)
+}
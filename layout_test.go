@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestLayouts(t *testing.T) {
+	c := testClient(t, nil)
+	a := &c.Accounts[0]
+	hitch := &Book{Title: "The Hitchhiker's Guide: Book?", FileName: "Hitch",
+		Authors: []string{"Douglas Adams"}, Series: "Hitchhiker's",
+		SeriesIndex: 1}
+	lone := &Book{Title: "Lone", FileName: "Lone"}
+	tests := []struct {
+		layout string
+		book   *Book
+		want   string
+	}{
+		{"", hitch, "Hitch.m4b"},
+		{"flat", lone, "Lone.m4b"},
+		{"audiobookshelf", hitch, "Douglas Adams/Hitchhiker's/" +
+			"Book 1 - The Hitchhiker's Guide - Book/" +
+			"The Hitchhiker's Guide - Book.m4b"},
+		{"audiobookshelf", lone, "Unknown Author/Lone/Lone.m4b"},
+		{"plex", hitch, "Douglas Adams/The Hitchhiker's Guide - Book/" +
+			"The Hitchhiker's Guide - Book.m4b"},
+		{"{{.Author}}/{{.Author}} - {{.Title}}", lone,
+			"Unknown Author/Unknown Author - Lone.m4b"},
+		{"{{.Series}}/../{{.FileName}}", lone, "Lone.m4b"},
+	}
+	for _, tt := range tests {
+		if _, err := getLayout(tt.layout); err != nil {
+			t.Errorf("getLayout(%q) = %s", tt.layout, err)
+			continue
+		}
+		got := c.relPath(c.audioPath(a, tt.book, tt.layout))
+		if got != tt.want {
+			t.Errorf("%q: audioPath(%s) = %q, want %q", tt.layout,
+				tt.book.FileName, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"kodi", "{{.Author", "{{.Publisher}}"} {
+		if _, err := getLayout(bad); err == nil {
+			t.Errorf("getLayout(%q) succeeded", bad)
+		}
+	}
+}
+
+// A book split into parts gets a directory even when its layout would
+// have it share one.
+func TestLayoutSplit(t *testing.T) {
+	c := testClient(t, nil)
+	a := &Account{Name: "test", Split: "chapters"}
+	b := &Book{Title: "Lone", FileName: "Lone", Authors: []string{"Anon"}}
+	for layout, want := range map[string]string{
+		"flat":                   "Lone/",
+		"{{.Author}}/{{.Title}}": "Anon/Lone/",
+		"plex":                   "Anon/Lone/",
+	} {
+		if got := c.relPath(c.bookDir(a, b, layout)); got != want {
+			t.Errorf("%q: bookDir() = %q, want %q", layout, got, want)
+		}
+		if !ownsDir(a, b, layout) {
+			t.Errorf("%q: ownsDir() = false", layout)
+		}
+	}
+}
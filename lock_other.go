@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package main
+
+import "os"
+
+// There's no flock(2) here, so instances aren't kept from sharing a
+// DataDir.
+func lockFile(f *os.File) error {
+	return nil
+}
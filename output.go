@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////
+//              _               _
+//   ___  _   _| |_ _ __  _   _| |_
+//  / _ \| | | | __| '_ \| | | | __|
+// | (_) | |_| | |_| |_) | |_| | |_
+//  \___/ \__,_|\__| .__/ \__,_|\__|
+//                 |_|
+////////////////////////////////////////////////////////////////////////
+
+// Describes one of the formats a book can be saved in.  Books are
+// always converted to an m4b first; if the account asks for anything
+// else that m4b is then copied or transcoded into the final file(s)
+// with ffmpeg using Args.  SplitExt is the extension used when the
+// book is split into several files, and Cover is whether the
+// container can hold the cover image.
+type OutputFormat struct {
+	Name     string
+	Ext      string
+	SplitExt string
+	Args     []string
+	Cover    bool
+}
+
+// Return the output format called NAME, which defaults to m4b, with
+// its bitrate set to BITRATE (in ffmpeg's notation, eg. "64k") or a
+// sensible default if it's empty.  The copy formats ignore BITRATE.
+func getOutputFormat(name, bitrate string) (OutputFormat, error) {
+	br := func(def string) string {
+		if bitrate != "" {
+			return bitrate
+		}
+		return def
+	}
+	switch name {
+	case "", "m4b":
+		return OutputFormat{"m4b", ".m4b", ".m4a",
+			[]string{"-c", "copy"}, true}, nil
+	case "m4a":
+		return OutputFormat{"m4a", ".m4a", ".m4a",
+			[]string{"-c", "copy"}, true}, nil
+	case "mp3":
+		return OutputFormat{"mp3", ".mp3", ".mp3",
+			[]string{"-c:a", "libmp3lame", "-b:a", br("64k"),
+				"-c:v", "copy", "-id3v2_version", "3"}, true}, nil
+	case "opus":
+		return OutputFormat{"opus", ".opus", ".opus",
+			[]string{"-c:a", "libopus", "-b:a", br("32k")}, false}, nil
+	case "ogg":
+		return OutputFormat{"ogg", ".ogg", ".ogg",
+			[]string{"-c:a", "libvorbis", "-b:a", br("64k")}, false}, nil
+	}
+	return OutputFormat{}, errors.New("Unknown output format " + name)
+}
+
+// Whether F merely copies the m4b's streams rather than transcoding.
+func (f OutputFormat) isCopy() bool {
+	return f.Args[0] == "-c" && f.Args[1] == "copy"
+}
+
+// The ways a book may be split, set with an account's split field.
+var splitModes = []string{"", "chapters", "duration", "size"}
+
+// A portion of a book written to its own file.  Start and End are in
+// seconds; a zero End means the rest of the book.  Chapters are kept
+// when the segment isn't itself a chapter.
+type segment struct {
+	Title    string
+	Start    float64
+	End      float64
+	Chapters bool
+}
+
+// Whether account A keeps books as the m4b files they were converted
+// to, in which case finishBook() has nothing to do.
+func (a *Account) keepsM4B() bool {
+	f, _ := getOutputFormat(a.Format, a.Bitrate)
+	return a.Split == "" && f.Name == "m4b"
+}
+
+// Make sure account A's output settings make sense.
+func (a *Account) validateOutput() error {
+	if _, err := getOutputFormat(a.Format, a.Bitrate); err != nil {
+		return err
+	}
+	known := false
+	for _, m := range splitModes {
+		known = known || a.Split == m
+	}
+	if !known {
+		return errors.New("unknown split mode " + a.Split)
+	}
+	if a.Split == "duration" {
+		d, err := time.ParseDuration(a.MaxDuration)
+		if err != nil {
+			return errors.New("bad maxduration: " + err.Error())
+		}
+		if d <= 0 {
+			return errors.New("maxduration must be positive")
+		}
+	}
+	if a.Split == "size" && a.MaxSize <= 0 {
+		return errors.New("split by size needs maxsize in megabytes")
+	}
+	return a.validateSidecars()
+}
+
+// Turn the converted book B in M4B into whatever account A's output
+// settings ask for: leaving it alone, transcoding it into another
+// format, or splitting it into a numbered file per chapter or per
+// part of at most a certain duration or size, in the book's directory
+// along with an M3U playlist of the parts.  Each
+// part is tagged with its track number and title; metadata and, when
+// the part isn't a chapter itself, chapters are carried over.  The
+// m4b is removed once everything has been written.
+func (c *Client) finishBook(a *Account, b *Book, m4b string) error {
+	f, err := getOutputFormat(a.Format, a.Bitrate)
+	if err != nil {
+		return err
+	}
+	if a.keepsM4B() {
+		return nil
+	}
+	if a.Split == "" {
+		out := c.audioPath(a, b, b.Layout)
+		err = encodeSegment(a, m4b, out, f,
+			segment{Chapters: true}, nil)
+		if err != nil {
+			return err
+		}
+		return os.Remove(m4b)
+	}
+
+	segs, err := c.segments(a, b, m4b, f)
+	if err != nil {
+		return err
+	}
+	// Don't throw away the book for want of anywhere to put it
+	if len(segs) == 0 {
+		return errors.New("book splits into no parts")
+	}
+	dir := c.bookDir(a, b, b.Layout)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	m3u := "#EXTM3U\n"
+	for i, s := range segs {
+		name := partName(i, s.Title, f.SplitExt)
+		meta := []string{
+			"-metadata", fmt.Sprintf("track=%d/%d", i+1, len(segs)),
+			"-metadata", "title=" + s.Title,
+			"-metadata", "album=" + b.Title,
+		}
+		if err = encodeSegment(a, m4b, dir+name, f, s, meta); err != nil {
+			return fmt.Errorf("Failed to write part %d: %s", i+1, err)
+		}
+		m3u += fmt.Sprintf("#EXTINF:%d,%s\n%s\n",
+			int(s.End-s.Start), s.Title, name)
+	}
+	err = os.WriteFile(dir+bookStem(b, b.Layout)+".m3u", []byte(m3u), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Remove(m4b)
+}
+
+// Return the file name, ending in EXT, of the part numbered I from 0
+// whose title is TITLE.  Chapter titles can contain anything, slashes
+// included.
+func partName(i int, title, ext string) string {
+	title = pathComponent(title, fmt.Sprintf("Part %d", i+1))
+	return fmt.Sprintf("%02d-%s%s", i+1, title, ext)
+}
+
+// Work out how account A's split setting divides book B in M4B, which
+// is about to be written in format F.
+func (c *Client) segments(a *Account, b *Book, m4b string, f OutputFormat) ([]segment, error) {
+	var segs []segment
+	if a.Split == "chapters" {
+		if len(b.Chapters) == 0 {
+			return nil, errors.New("no chapters to split on")
+		}
+		for _, ch := range b.Chapters {
+			segs = append(segs, segment{ch.Title, ch.Start, ch.End,
+				false})
+		}
+		return segs, nil
+	}
+
+	total, err := probeDuration(m4b)
+	if err != nil {
+		return nil, err
+	}
+	var max float64
+	if a.Split == "duration" {
+		d, _ := time.ParseDuration(a.MaxDuration)
+		max = d.Seconds()
+	} else {
+		// Estimate how many seconds fit in MaxSize from the m4b
+		// if we're copying or the bitrate if we're transcoding,
+		// leaving a little room for metadata and the cover.
+		var bps float64
+		if f.isCopy() {
+			fi, err := os.Stat(m4b)
+			if err != nil {
+				return nil, err
+			}
+			bps = float64(fi.Size()) / total
+		} else {
+			bps = bitrateBytes(f.Args)
+		}
+		max = float64(a.MaxSize) * 1024 * 1024 * 0.95 / bps
+	}
+	n := int(math.Ceil(total / max))
+	for i := 0; i < n; i++ {
+		end := math.Min(float64(i+1)*max, total)
+		segs = append(segs, segment{
+			Title:    fmt.Sprintf("%s Part %d", b.Title, i+1),
+			Start:    float64(i) * max,
+			End:      end,
+			Chapters: true,
+		})
+	}
+	return segs, nil
+}
+
+// Return the bitrate in bytes per second set by the -b:a flag in ARGS.
+func bitrateBytes(args []string) float64 {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] != "-b:a" {
+			continue
+		}
+		s := strings.TrimSuffix(strings.ToLower(args[i+1]), "k")
+		kbps, err := strconv.ParseFloat(s, 64)
+		if err == nil {
+			return kbps * 1000 / 8
+		}
+	}
+	return 64 * 1000 / 8
+}
+
+// Return the duration, in seconds, of the media file in PATH.
+func probeDuration(path string) (float64, error) {
+	out, err := exec.Command("ffprobe", "-v", "quiet",
+		"-show_entries", "format=duration", "-of", "csv=p=0",
+		path).Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+// Write the segment S of the book in IN to OUT in format F, adding
+// the ffmpeg metadata flags in META.
+func encodeSegment(a *Account, in, out string, f OutputFormat, s segment, meta []string) error {
+	args := []string{"-y", "-v", "error"}
+	if s.End > 0 {
+		args = append(args,
+			"-ss", strconv.FormatFloat(s.Start, 'f', 3, 64),
+			"-to", strconv.FormatFloat(s.End, 'f', 3, 64))
+	}
+	args = append(args, "-i", in, "-map", "0:a", "-map_metadata", "0")
+	if f.Cover {
+		args = append(args, "-map", "0:v?")
+	}
+	if s.Chapters {
+		args = append(args, "-map_chapters", "0")
+	} else {
+		args = append(args, "-map_chapters", "-1")
+	}
+	args = append(args, f.Args...)
+	args = append(args, meta...)
+	args = append(args, out)
+
+	cmd := exec.Command("ffmpeg", args...)
+	stderr, _ := cmd.StderrPipe()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	slurp, _ := io.ReadAll(stderr)
+	if err := cmd.Wait(); err != nil {
+		a.Log("ffmpeg failed to write %s: %s", out, slurp)
+		os.Remove(out)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestValidateMaxDuration(t *testing.T) {
+	tests := []struct {
+		max string
+		ok  bool
+	}{
+		{"1h30m", true},
+		{"0s", false},
+		{"-1h", false},
+		{"soon", false},
+	}
+	for _, tt := range tests {
+		a := Account{Split: "duration", MaxDuration: tt.max}
+		if err := a.validateOutput(); (err == nil) != tt.ok {
+			t.Errorf("validateOutput() with maxduration %s = %v",
+				tt.max, err)
+		}
+	}
+}
+
+func TestPartName(t *testing.T) {
+	tests := []struct {
+		i     int
+		title string
+		want  string
+	}{
+		{0, "Prologue", "01-Prologue.m4a"},
+		{1, "Part 1/2: The End", "02-Part 1-2 - The End.m4a"},
+		{2, "???", "03-Part 3.m4a"},
+	}
+	for _, tt := range tests {
+		if got := partName(tt.i, tt.title, ".m4a"); got != tt.want {
+			t.Errorf("partName(%d, %q) = %q, want %q", tt.i, tt.title,
+				got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+)
+
+////////////////////////////////////////////////////////////////////////
+//                    _ _ _
+//   __ _ _   _  __ _| (_) |_ _   _
+//  / _` | | | |/ _` | | | __| | | |
+// | (_| | |_| | (_| | | | |_| |_| |
+//  \__, |\__,_|\__,_|_|_|\__|\__, |
+//     |_|                    |___/
+////////////////////////////////////////////////////////////////////////
+
+// Audible's codec variants, ordered from highest to lowest quality.
+// The plain "AAX" codec is whatever Audible considers the default,
+// which in practice is equivalent to AAX_22_64.
+var codecsByQuality = []string{"AAX_44_128", "AAX_44_64", "AAX_22_64",
+	"AAX_22_32"}
+
+// The codec we ask for first at each quality setting.
+var qualityCodecs = map[string]string{
+	"highest": "AAX_44_128",
+	"high":    "AAX_44_64",
+	"normal":  "AAX_22_64",
+	"low":     "AAX_22_32",
+}
+
+// Validate and set the quality to use for this run, overriding the
+// quality configured for each account.
+func (c *Client) SetQuality(quality string) {
+	if quality != "" && qualityCodecs[quality] == "" {
+		log.Fatalf("Unknown quality %s, expected one of highest, "+
+			"high, normal, or low", quality)
+	}
+	c.runQuality = quality
+}
+
+// Return the quality account A should download books in, or an empty
+// string if neither the account nor the command line specifies one.
+func (c *Client) quality(a *Account) string {
+	if c.runQuality != "" {
+		return c.runQuality
+	}
+	return a.Quality
+}
+
+// Return the codecs to try when downloading a book for A, in order.
+// Without a quality preference we ask for the default AAX codec and
+// fall back through every other codec from highest to lowest quality.
+// Otherwise we start at the preferred codec, work our way down, and
+// then back up, since a refused low quality book is still better
+// than no book at all.
+func (c *Client) codecLadder(a *Account) []string {
+	want := qualityCodecs[c.quality(a)]
+	if want == "" {
+		return append([]string{"AAX"}, codecsByQuality...)
+	}
+	i := codecRank(want)
+	ladder := append([]string{}, codecsByQuality[i:]...)
+	for j := i - 1; j >= 0; j-- {
+		ladder = append(ladder, codecsByQuality[j])
+	}
+	return append(ladder, "AAX")
+}
+
+// Return the position of CODEC in codecsByQuality, lower is better.
+// Books downloaded before we recorded their codec were fetched as
+// plain AAX.
+func codecRank(codec string) int {
+	for i, c := range codecsByQuality {
+		if c == codec {
+			return i
+		}
+	}
+	return codecRank(qualityCodecs["normal"])
+}
+
+// Return the name of the quality setting corresponding to CODEC.
+func codecQuality(codec string) string {
+	return qualityName(codecRank(codec))
+}
+
+// Return the name of the quality setting at RANK in codecsByQuality.
+func qualityName(rank int) string {
+	for q, c := range qualityCodecs {
+		if c == codecsByQuality[rank] {
+			return q
+		}
+	}
+	return ""
+}
+
+// Return the download URL URI with its codec parameter set to CODEC.
+func codecURL(uri, codec string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	q := u.Query()
+	q.Set("codec", codec)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Re-download every previously downloaded book which was archived at
+// a lower quality than its account, or the command line, asks for,
+// replacing the old file if we get something better.  ACCOUNT limits
+// the upgrade to a single account.
+func (c *Client) UpgradeLibrary(account string) []BookResult {
+	var results []BookResult
+	for _, b := range c.Downloaded {
+		if c.ctx.Err() != nil {
+			break
+		}
+		a, err := c.bookAccount(&b, account)
+		if err != nil {
+			log.Printf("Skipping %s: %s", b.Title, err)
+			continue
+		}
+		if account != "" && a.Name != account {
+			continue
+		}
+		r := BookResult{
+			Account: a.Name,
+			Title:   b.Title,
+			Status:  BookSkipped,
+		}
+		want := c.quality(a)
+		old := codecRank(b.Codec)
+		if want == "" || old <= codecRank(qualityCodecs[want]) {
+			results = append(results, r)
+			continue
+		}
+		r.Status = BookFailed
+		aax, ok := c.downloadBook(a, &b, &r)
+		if !ok {
+			results = append(results, r)
+			continue
+		}
+		if codecRank(b.Codec) >= old {
+			fmt.Printf("Audible only offers %s in %s quality\n",
+				b.Title, qualityName(old))
+			os.Remove(aax)
+			r.Status = BookSkipped
+			results = append(results, r)
+			continue
+		}
+		c.convertBook(a, &b, aax, &r)
+		results = append(results, r)
+	}
+	return results
+}
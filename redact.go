@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////
+//                _            _   _
+//  _ __ ___  __| | __ _  ___| |_(_) ___  _ __
+// | '__/ _ \/ _` |/ _` |/ __| __| |/ _ \| '_ \
+// | | |  __/ (_| | (_| | (__| |_| | (_) | | | |
+// |_|  \___|\__,_|\__,_|\___|\__|_|\___/|_| |_|
+////////////////////////////////////////////////////////////////////////
+
+// Secrets are replaced with this string wherever they appear in
+// debugging output.
+const redacted string = "[REDACTED]"
+
+// Secrets shorter than this are left alone; cookies with values like
+// "0" or "-" would otherwise mangle everything around them.
+const minRedactLen int = 6
+
+// Amazon customer IDs show up in the library page's embedded json and
+// analytics blobs, either in their opaque "amzn1.account." form or as
+// an "A" followed by a dozen or so uppercase letters and digits.
+var customerIDRegexp = regexp.MustCompile(
+	`amzn1\.account\.[0-9A-Za-z]+|\bA[0-9A-Z]{12,13}\b`)
+
+// Return a stable name for the account that can appear in bug reports
+// without revealing the name in the config file.
+func (a *Account) pseudonym() string {
+	sum := sha256.Sum256([]byte(a.Name))
+	return "account-" + hex.EncodeToString(sum[:])[:6]
+}
+
+// Return S with the account's activation bytes, cookie values, name,
+// and anything resembling a customer ID removed.
+func (a *Account) Redact(s string) string {
+	if len(a.Bytes) >= minRedactLen {
+		s = strings.ReplaceAll(s, a.Bytes, redacted)
+	}
+	for _, c := range a.Auth {
+		if len(c.Value) >= minRedactLen {
+			s = strings.ReplaceAll(s, c.Value, redacted)
+		}
+	}
+	s = customerIDRegexp.ReplaceAllString(s, redacted)
+	// Very short names are too likely to match innocent words
+	if len(a.Name) >= 3 {
+		name := regexp.MustCompile(`\b` + regexp.QuoteMeta(a.Name) + `\b`)
+		s = name.ReplaceAllString(s, a.pseudonym())
+	}
+	return s
+}
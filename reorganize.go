@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////
+//                                        _
+//  _ __ ___  ___  _ __ __ _  __ _ _ __ (_)_______
+// | '__/ _ \/ _ \| '__/ _` |/ _` | '_ \| |_  / _ \
+// | | |  __/ (_) | | | (_| | (_| | | | | |/ /  __/
+// |_|  \___|\___/|_|  \__, |\__,_|_| |_|_/___\___|
+//                     |___/
+////////////////////////////////////////////////////////////////////////
+
+// The plan for a reorganization is kept in this file in DataDir while
+// it's carried out so that it can be resumed if it's interrupted.
+const reorganizeJournal string = "reorganize.json"
+
+// A single file to be moved.  From and To are relative to SaveDir.
+type fileMove struct {
+	From string
+	To   string
+	Done bool
+}
+
+// Everything that needs to happen to move one book into Layout, after
+// which its files will be Files.  A book is moved completely or not
+// at all; Failed is why it wasn't.
+type bookMove struct {
+	Title  string
+	Layout string
+	Files  []BookFile
+	Moves  []fileMove
+	Done   bool
+	Failed string
+}
+
+// Implement the reorganize subcommand, which moves every downloaded
+// book belonging to ACCOUNT, or to any account if it's empty, to where
+// the current layout and naming rules want it.  With --dry-run the
+// plan is only printed.  If a previous reorganization was interrupted
+// it's finished first.
+func (c *Client) ReorganizeCommand(account string, argv []string) {
+	fs := flag.NewFlagSet("reorganize", flag.ExitOnError)
+	dryrun := fs.Bool("dry-run", false, "")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: audible-dl reorganize "+
+			"[--dry-run]\n")
+	}
+	fs.Parse(argv)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	plan, err := c.readJournal()
+	unwrap(err)
+	if plan != nil {
+		fmt.Println("Resuming an interrupted reorganization")
+	} else {
+		plan = c.planReorganize(account)
+	}
+	printPlan(plan)
+	if *dryrun || len(plan) == 0 {
+		return
+	}
+
+	unwrap(c.writeJournal(plan))
+	failed := 0
+	for i := range plan {
+		bm := &plan[i]
+		if bm.Done {
+			continue
+		}
+		if err := c.applyBookMove(bm, plan); err != nil {
+			log.Printf("Failed to move %s: %s", bm.Title, err)
+			bm.Failed = err.Error()
+			failed++
+		} else {
+			b := c.Downloaded[bm.Title]
+			b.Layout = bm.Layout
+			b.Files = bm.Files
+			c.Downloaded[bm.Title] = b
+			c.SetDownloaded()
+		}
+		bm.Done = true
+		unwrap(c.writeJournal(plan))
+	}
+	c.writeManifests(nil)
+	unwrap(os.Remove(c.DataDir + reorganizeJournal))
+	fmt.Printf("Moved %d books\n", len(plan)-failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// Work out where every file of every downloaded book belonging to
+// ACCOUNT, or to any account if it's empty, needs to go.  Books which
+// are already where they should be are left out.
+func (c *Client) planReorganize(account string) []bookMove {
+	var plan []bookMove
+	want, _ := getLayout(c.Layout)
+	for title, b := range c.Downloaded {
+		a, err := c.bookAccount(&b, account)
+		if err != nil {
+			log.Printf("Skipping %s: %s", title, err)
+			continue
+		}
+		if account != "" && a.Name != account {
+			continue
+		}
+		bm := bookMove{Title: title, Layout: want.Name}
+		for _, f := range c.bookFiles(&b, account) {
+			to := c.movedPath(a, &b, f.Path, want.Name)
+			moved := f
+			moved.Path = to
+			bm.Files = append(bm.Files, moved)
+			if to != f.Path {
+				bm.Moves = append(bm.Moves, fileMove{From: f.Path,
+					To: to})
+			}
+		}
+		if len(bm.Moves) > 0 {
+			plan = append(plan, bm)
+		}
+	}
+	return plan
+}
+
+// Return where the file PATH of book B of account A, saved under B's
+// layout, goes under the layout called TO.  The audio and sidecars are
+// renamed to suit the new layout, as is anything else named after the
+// book, like a cover or companion PDF.  Other files keep their names
+// in the book's directory, or are prefixed with the name of the book's
+// files when they're moved into a directory it shares.  Books imported with
+// import-existing may have been anywhere: those outside SaveDir are
+// left there, and those inside it are moved as if they'd been named
+// after the book.
+func (c *Client) movedPath(a *Account, b *Book, path, to string) string {
+	from := b.Layout
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if path == c.relPath(c.audioPath(a, b, from)) {
+		return c.relPath(c.audioPath(a, b, to))
+	}
+	for _, s := range sidecars {
+		if path == c.relPath(c.sidecarPath(a, b, s, from)) {
+			return c.relPath(c.sidecarPath(a, b, s, to))
+		}
+	}
+	fromDir := c.relPath(c.bookDir(a, b, from))
+	name := strings.TrimPrefix(path, fromDir)
+	dir := c.relPath(c.bookDir(a, b, to))
+	if !strings.HasPrefix(path, fromDir) ||
+		!ownsDir(a, b, from) && strings.Contains(name, "/") {
+		name = filepath.Base(path)
+		if len(b.Files) == 1 {
+			return dir + bookStem(b, to) + filepath.Ext(name)
+		}
+	}
+	if stem := bookStem(b, from) + "."; strings.HasPrefix(name, stem) {
+		return dir + bookStem(b, to) + "." + name[len(stem):]
+	}
+	if ownsDir(a, b, to) {
+		return dir + name
+	}
+	return dir + bookStem(b, to) + "." + name
+}
+
+// Print what PLAN is going to do.
+func printPlan(plan []bookMove) {
+	if len(plan) == 0 {
+		fmt.Println("Every book is already where it belongs")
+		return
+	}
+	for _, bm := range plan {
+		if bm.Done {
+			continue
+		}
+		fmt.Printf("%s\n", bold(bm.Title))
+		for _, m := range bm.Moves {
+			if !m.Done {
+				fmt.Printf("  %s -> %s\n", m.From, m.To)
+			}
+		}
+	}
+}
+
+// Carry out the moves in BM, recording each one in the journal along
+// with the rest of PLAN as it's done.  If any fails, those already
+// made are undone.  Moves which were made before an interruption
+// but not recorded are recognized by their source having gone and
+// their destination existing.
+func (c *Client) applyBookMove(bm *bookMove, plan []bookMove) error {
+	exists := func(rel string) bool {
+		_, err := os.Stat(c.SaveDir + rel)
+		return err == nil
+	}
+	var err error
+	for i := range bm.Moves {
+		m := &bm.Moves[i]
+		if m.Done {
+			continue
+		}
+		if !exists(m.From) && exists(m.To) {
+			m.Done = true
+			continue
+		}
+		if exists(m.To) {
+			err = errors.New(m.To + " already exists")
+			break
+		}
+		fmt.Printf("%s %s -> %s\n", bold("Moving"), m.From, m.To)
+		err = os.MkdirAll(filepath.Dir(c.SaveDir+m.To), 0755)
+		if err == nil {
+			err = os.Rename(c.SaveDir+m.From, c.SaveDir+m.To)
+		}
+		if err != nil {
+			break
+		}
+		m.Done = true
+		if err = c.writeJournal(plan); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		for i := len(bm.Moves) - 1; i >= 0; i-- {
+			m := &bm.Moves[i]
+			if !m.Done {
+				continue
+			}
+			if rberr := os.Rename(c.SaveDir+m.To, c.SaveDir+m.From); rberr != nil {
+				log.Printf("Failed to move %s back: %s", m.To, rberr)
+				continue
+			}
+			m.Done = false
+		}
+		return err
+	}
+	for _, m := range bm.Moves {
+		c.removeEmptyDirs(filepath.Dir(c.SaveDir + m.From))
+	}
+	return nil
+}
+
+// Return the plan of an interrupted reorganization, or nil if there
+// isn't one.
+func (c *Client) readJournal() ([]bookMove, error) {
+	path := c.DataDir + reorganizeJournal
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if raw, err = upgradeState(stateJournal, path, raw, nil); err != nil {
+		return nil, err
+	}
+	var journal journalFile
+	if err = json.Unmarshal(raw, &journal); err != nil {
+		return nil, fmt.Errorf("Bad json in %s: %s", reorganizeJournal, err)
+	}
+	return journal.Books, nil
+}
+
+// Save PLAN, overwriting the journal's old contents.
+func (c *Client) writeJournal(plan []bookMove) error {
+	raw, _ := json.MarshalIndent(journalFile{
+		Version: currentVersion(stateJournal),
+		Books:   plan,
+	}, "", "  ")
+	return writeFileAtomic(c.DataDir+reorganizeJournal, raw, 0644)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Create each of the files PATHS, relative to C's SaveDir, holding its
+// own name.
+func testSaveFiles(t *testing.T, c *Client, paths ...string) {
+	for _, p := range paths {
+		if err := os.MkdirAll(filepath.Dir(c.SaveDir+p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(c.SaveDir+p, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Check that the file PATH, relative to C's SaveDir, holds the name it
+// was created with, FROM, or doesn't exist if FROM is empty.
+func testSavedFile(t *testing.T, c *Client, path, from string) {
+	t.Helper()
+	raw, err := os.ReadFile(c.SaveDir + path)
+	switch {
+	case from == "" && err == nil:
+		t.Errorf("%s still exists", path)
+	case from != "" && err != nil:
+		t.Errorf("%s is missing: %s", path, err)
+	case from != "" && string(raw) != from:
+		t.Errorf("%s holds %s, want %s", path, raw, from)
+	}
+}
+
+func TestApplyBookMove(t *testing.T) {
+	c := testClient(t, nil)
+	testSaveFiles(t, c, "A_Book.m4b", "A_Book.desc.txt")
+	plan := []bookMove{{Title: "A Book", Moves: []fileMove{
+		{From: "A_Book.m4b", To: "Author/A Book/A Book.m4b"},
+		{From: "A_Book.desc.txt", To: "Author/A Book/desc.txt"},
+	}}}
+	if err := c.applyBookMove(&plan[0], plan); err != nil {
+		t.Fatal(err)
+	}
+	testSavedFile(t, c, "Author/A Book/A Book.m4b", "A_Book.m4b")
+	testSavedFile(t, c, "Author/A Book/desc.txt", "A_Book.desc.txt")
+	testSavedFile(t, c, "A_Book.m4b", "")
+	journal, err := c.readJournal()
+	if err != nil || len(journal) != 1 {
+		t.Fatalf("readJournal() = %v, %v", journal, err)
+	}
+	for _, m := range journal[0].Moves {
+		if !m.Done {
+			t.Errorf("move of %s wasn't recorded", m.From)
+		}
+	}
+}
+
+// A book whose files can't all be moved is put back where it was.
+func TestApplyBookMovePartial(t *testing.T) {
+	c := testClient(t, nil)
+	testSaveFiles(t, c, "old/A Book.m4b", "old/cover.jpg", "old/A Book.pdf",
+		"new/cover.jpg")
+	plan := []bookMove{{Title: "A Book", Moves: []fileMove{
+		{From: "old/A Book.m4b", To: "new/A Book.m4b"},
+		{From: "old/cover.jpg", To: "new/cover.jpg"},
+		{From: "old/A Book.pdf", To: "new/A Book.pdf"},
+	}}}
+	if err := c.applyBookMove(&plan[0], plan); err == nil {
+		t.Fatal("applyBookMove() succeeded despite a clash")
+	}
+	testSavedFile(t, c, "old/A Book.m4b", "old/A Book.m4b")
+	testSavedFile(t, c, "old/cover.jpg", "old/cover.jpg")
+	testSavedFile(t, c, "old/A Book.pdf", "old/A Book.pdf")
+	testSavedFile(t, c, "new/cover.jpg", "new/cover.jpg")
+	testSavedFile(t, c, "new/A Book.m4b", "")
+	testSavedFile(t, c, "new/A Book.pdf", "")
+	for _, m := range plan[0].Moves {
+		if m.Done {
+			t.Errorf("move of %s is still marked done", m.From)
+		}
+	}
+}
+
+// A reorganization interrupted after moving a file but before
+// recording it picks up where it left off.
+func TestApplyBookMoveResume(t *testing.T) {
+	c := testClient(t, nil)
+	testSaveFiles(t, c, "new/A Book.m4b", "new/cover.jpg", "old/A Book.pdf")
+	plan := []bookMove{{Title: "A Book", Moves: []fileMove{
+		{From: "old/A Book.m4b", To: "new/A Book.m4b", Done: true},
+		{From: "old/cover.jpg", To: "new/cover.jpg"},
+		{From: "old/A Book.pdf", To: "new/A Book.pdf"},
+	}}}
+	if err := c.writeJournal(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := c.readJournal()
+	if err != nil || len(plan) != 1 {
+		t.Fatalf("readJournal() = %v, %v", plan, err)
+	}
+	if err = c.applyBookMove(&plan[0], plan); err != nil {
+		t.Fatal(err)
+	}
+	testSavedFile(t, c, "new/A Book.m4b", "new/A Book.m4b")
+	testSavedFile(t, c, "new/cover.jpg", "new/cover.jpg")
+	testSavedFile(t, c, "new/A Book.pdf", "old/A Book.pdf")
+	if _, err = os.Stat(c.SaveDir + "old"); !os.IsNotExist(err) {
+		t.Errorf("the emptied directory wasn't removed: %v", err)
+	}
+	for _, m := range plan[0].Moves {
+		if !m.Done {
+			t.Errorf("move of %s isn't marked done", m.From)
+		}
+	}
+}
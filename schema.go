@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+////////////////////////////////////////////////////////////////////////
+//           _
+//  ___  ___| |__   ___ _ __ ___   __ _
+// / __|/ __| '_ \ / _ \ '_ ` _ \ / _` |
+// \__ \ (__| | | |  __/ | | | | | (_| |
+// |___/\___|_| |_|\___|_| |_| |_|\__,_|
+////////////////////////////////////////////////////////////////////////
+
+// The kinds of state file which carry a version.  The activation
+// bytes files don't: they hold nothing but the bytes, whose format is
+// Audible's, not ours.
+const (
+	stateConfig     = "config"
+	stateCookies    = "cookies"
+	stateDownloaded = "downloaded"
+	stateFailed     = "failed"
+	stateVerified   = "verified"
+	stateJournal    = "journal"
+	stateReview     = "review"
+)
+
+// Upgrades the contents of a state file of kind Kind from version From
+// to From+1.  Files from before versions were recorded are version 0.
+type migration struct {
+	Kind    string
+	From    int
+	Migrate func(raw []byte) ([]byte, error)
+}
+
+// Every migration, in order.  Whenever a change to Book, Account, or
+// anything else stored on disk would make old files read wrongly, add
+// a migration for each kind of file affected, which also bumps its
+// version, see currentVersion().
+var migrations = []migration{
+	{stateConfig, 0, migrateConfigV0},
+	{stateCookies, 0, wrapV0("Cookies")},
+	{stateDownloaded, 0, wrapV0("Books")},
+	{stateFailed, 0, wrapV0("Books")},
+	{stateVerified, 0, addVersionV0},
+	{stateJournal, 0, wrapV0("Books")},
+	{stateReview, 0, wrapV0("Matches")},
+}
+
+// The on-disk format of <name>.cookies.json.
+type cookieFile struct {
+	Version int
+	Cookies []*http.Cookie
+}
+
+// The on-disk format of downloaded_books.json.
+type bookStore struct {
+	Version int
+	Books   []Book
+}
+
+// The on-disk format of failed_books.json.
+type failedStore struct {
+	Version int
+	Books   []FailedBook
+}
+
+// The on-disk format of reorganize.json.
+type journalFile struct {
+	Version int
+	Books   []bookMove
+}
+
+// The format of import-existing's review files.
+type reviewFile struct {
+	Version int
+	Matches []importMatch
+}
+
+// Return the version this build writes state files of KIND in, which
+// is how many migrations there are for it.
+func currentVersion(kind string) int {
+	v := 0
+	for _, m := range migrations {
+		if m.Kind == kind {
+			v++
+		}
+	}
+	return v
+}
+
+// Return the version of the state file of KIND in RAW.
+func stateVersion(kind string, raw []byte) (int, error) {
+	var v struct {
+		Version int `yaml:"version"`
+	}
+	if kind == stateConfig {
+		err := yaml.Unmarshal(raw, &v)
+		return v.Version, err
+	}
+	// Before versions these were bare arrays, or null when empty
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] == '[' || string(raw) == "null" {
+		return 0, nil
+	}
+	err := json.Unmarshal(raw, &v)
+	return v.Version, err
+}
+
+// Bring RAW, the contents of the state file of KIND in PATH, up to the
+// current version.  If it's changed and WRITE isn't nil, the file on
+// disk is backed up as PATH.vN, where N is its old version, and WRITE
+// is used to replace it.  Files written by a newer audible-dl than
+// this one are refused rather than risk misreading and overwriting
+// them.
+func upgradeState(kind, path string, raw []byte, write func([]byte) error) ([]byte, error) {
+	from, err := stateVersion(kind, raw)
+	if err != nil {
+		return nil, err
+	}
+	to := currentVersion(kind)
+	if from > to {
+		return nil, fmt.Errorf("%s is version %d, but this audible-dl "+
+			"only understands up to version %d; please upgrade it",
+			path, from, to)
+	}
+	if from == to {
+		return raw, nil
+	}
+	up := raw
+	for v := from; v < to; v++ {
+		for _, m := range migrations {
+			if m.Kind == kind && m.From == v {
+				if up, err = m.Migrate(up); err != nil {
+					return nil, fmt.Errorf("Failed to upgrade %s "+
+						"from version %d: %s", path, v, err)
+				}
+			}
+		}
+	}
+	if write == nil {
+		return up, nil
+	}
+	backup := fmt.Sprintf("%s.v%d", path, from)
+	if disk, err := os.ReadFile(path); err == nil {
+		if err = writeFileAtomic(backup, disk, filePerm(path)); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err = write(up); err != nil {
+		return nil, err
+	}
+	log.Printf("Upgraded %s from version %d to %d, the old one is in %s",
+		path, from, to, backup)
+	return up, nil
+}
+
+// Like upgradeState(), but exit if anything goes wrong, and write the
+// upgraded file to PATH in plain text with the same permissions.
+func mustUpgradeState(kind, path string, raw []byte) []byte {
+	up, err := upgradeState(kind, path, raw, func(up []byte) error {
+		return writeFileAtomic(path, up, filePerm(path))
+	})
+	unwrap(err)
+	return up
+}
+
+// Return the permissions of the file in PATH, or 0644 if it can't be
+// read.
+func filePerm(path string) os.FileMode {
+	if fi, err := os.Stat(path); err == nil {
+		return fi.Mode().Perm()
+	}
+	return 0644
+}
+
+// Config files gained a version field, which is all that changed.
+func migrateConfigV0(raw []byte) ([]byte, error) {
+	if len(raw) > 0 && raw[len(raw)-1] != '\n' {
+		raw = append(raw, '\n')
+	}
+	return append(raw, []byte("version: 1\n")...), nil
+}
+
+// Return a migration for json files which used to be a bare array and
+// are now an object with the array in FIELD alongside a version.
+func wrapV0(field string) func(raw []byte) ([]byte, error) {
+	return func(raw []byte) ([]byte, error) {
+		var list json.RawMessage
+		if len(bytes.TrimSpace(raw)) == 0 {
+			list = json.RawMessage("null")
+		} else if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(map[string]interface{}{
+			"Version": 1,
+			field:     list,
+		}, "", "  ")
+	}
+}
+
+// Json objects which gained a version field and nothing else.
+func addVersionV0(raw []byte) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		obj = make(map[string]json.RawMessage)
+	}
+	obj["Version"] = json.RawMessage("1")
+	return json.MarshalIndent(obj, "", "  ")
+}
+
+// Return the cookies in the cookie file RAW, which is read from PATH,
+// upgrading it in memory if it's old.
+func parseCookies(path string, raw []byte) ([]*http.Cookie, error) {
+	up, err := upgradeState(stateCookies, path, raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	var f cookieFile
+	err = json.Unmarshal(up, &f)
+	return f.Cookies, err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWrapV0(t *testing.T) {
+	for _, raw := range []string{`[{"Title": "A Book"}]`, "", "null"} {
+		up, err := wrapV0("Books")([]byte(raw))
+		if err != nil {
+			t.Fatalf("wrapV0(%q) = %s", raw, err)
+		}
+		var store bookStore
+		if err = json.Unmarshal(up, &store); err != nil {
+			t.Fatalf("wrapV0(%q) = %s: %s", raw, up, err)
+		}
+		if store.Version != 1 {
+			t.Errorf("wrapV0(%q) version = %d", raw, store.Version)
+		}
+		if raw != "" && raw != "null" &&
+			(len(store.Books) != 1 || store.Books[0].Title != "A Book") {
+			t.Errorf("wrapV0(%q) books = %+v", raw, store.Books)
+		}
+	}
+	if _, err := wrapV0("Books")([]byte("[{")); err == nil {
+		t.Errorf("wrapV0() of broken json succeeded")
+	}
+}
+
+func TestAddVersionV0(t *testing.T) {
+	for _, raw := range []string{`{"Checked": "2022-07-07"}`, "null"} {
+		up, err := addVersionV0([]byte(raw))
+		if err != nil {
+			t.Fatalf("addVersionV0(%q) = %s", raw, err)
+		}
+		var obj map[string]json.RawMessage
+		if err = json.Unmarshal(up, &obj); err != nil {
+			t.Fatal(err)
+		}
+		if string(obj["Version"]) != "1" {
+			t.Errorf("addVersionV0(%q) = %s", raw, up)
+		}
+		if raw != "null" && string(obj["Checked"]) != `"2022-07-07"` {
+			t.Errorf("addVersionV0(%q) lost a field: %s", raw, up)
+		}
+	}
+}
+
+func TestUpgradeConfig(t *testing.T) {
+	up, err := upgradeState(stateConfig, "config.yml",
+		[]byte("accounts: []"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := stateVersion(stateConfig, up); err != nil || v != 1 {
+		t.Errorf("upgraded config is version %d, %v:\n%s", v, err, up)
+	}
+}
+
+// Files from a newer audible-dl are left alone.
+func TestUpgradeStateNewer(t *testing.T) {
+	raw := []byte(`{"Version": 99, "Books": []}`)
+	wrote := false
+	_, err := upgradeState(stateDownloaded, "downloaded_books.json", raw,
+		func([]byte) error {
+			wrote = true
+			return nil
+		})
+	if err == nil || !strings.Contains(err.Error(), "version 99") {
+		t.Errorf("upgradeState() = %v, want a refusal", err)
+	}
+	if wrote {
+		t.Errorf("upgradeState() overwrote a newer file")
+	}
+}
+
+// Upgraded files are backed up first, with their permissions intact,
+// and current ones aren't touched.
+func TestUpgradeStateBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failed_books.json")
+	old := []byte(`[{"Title": "A Book", "Attempts": 2}]`)
+	if err := os.WriteFile(path, old, 0600); err != nil {
+		t.Fatal(err)
+	}
+	write := func(up []byte) error {
+		return writeFileAtomic(path, up, filePerm(path))
+	}
+	up, err := upgradeState(stateFailed, path, old, write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := os.ReadFile(path + ".v0")
+	if err != nil || string(backup) != string(old) {
+		t.Errorf("backup = %q, %v", backup, err)
+	}
+	if fi, err := os.Stat(path + ".v0"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("backup's permissions = %v, %v", fi.Mode(), err)
+	}
+	disk, err := os.ReadFile(path)
+	if err != nil || string(disk) != string(up) {
+		t.Errorf("upgraded file = %q, %v", disk, err)
+	}
+	var store failedStore
+	if err = json.Unmarshal(disk, &store); err != nil || store.Version != 1 ||
+		len(store.Books) != 1 || store.Books[0].Attempts != 2 {
+		t.Errorf("upgraded file = %s, %v", disk, err)
+	}
+
+	os.Remove(path + ".v0")
+	again, err := upgradeState(stateFailed, path, disk, write)
+	if err != nil || string(again) != string(disk) {
+		t.Errorf("upgradeState() of a current file = %s, %v", again, err)
+	}
+	if _, err = os.Stat(path + ".v1"); !os.IsNotExist(err) {
+		t.Errorf("a current file was backed up")
+	}
+}
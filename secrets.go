@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////
+//                         _
+//  ___  ___  ___ _ __ ___| |_ ___
+// / __|/ _ \/ __| '__/ _ \ __/ __|
+// \__ \  __/ (__| | |  __/ |_\__ \
+// |___/\___|\___|_|  \___|\__|___/
+////////////////////////////////////////////////////////////////////////
+
+// Encrypted files begin with this magic string, followed by the salt
+// used to derive the key, the GCM nonce, and the sealed contents.
+const secretMagic string = "audible-dl secret v1\n"
+
+// Number of PBKDF2 rounds used to turn a passphrase into a key.
+const secretRounds int = 200000
+
+const secretSaltLen int = 16
+
+// Encrypted copies of an account's secrets live next to the
+// plain-text ones with this suffix appended.
+const secretSuffix string = ".enc"
+
+// Return the path of the file in DataDir holding ACCOUNT's activation
+// bytes once they've been moved out of the config file.
+func (c *Client) bytesPath(account string) string {
+	return c.DataDir + account + ".bytes"
+}
+
+// Return the path of the file in DataDir holding ACCOUNT's cookies.
+func (c *Client) cookiesPath(account string) string {
+	return c.DataDir + account + ".cookies.json"
+}
+
+// Return the secret used to derive encryption keys, reading it from
+// the key file named in the config or $AUDIBLE_DL_KEYFILE, from
+// $AUDIBLE_DL_PASSPHRASE, or, failing those, by prompting the user.
+// The result is cached for the rest of the run.
+func (c *Client) passphrase() []byte {
+	if c.secret != nil {
+		return c.secret
+	}
+	keyfile := os.Getenv("AUDIBLE_DL_KEYFILE")
+	if keyfile == "" {
+		keyfile = c.KeyFile
+	}
+	if keyfile != "" {
+		raw, err := os.ReadFile(keyfile)
+		expect(err, "Failed to read key file "+keyfile)
+		c.secret = bytes.TrimSpace(raw)
+	} else if p := os.Getenv("AUDIBLE_DL_PASSPHRASE"); p != "" {
+		c.secret = []byte(p)
+	} else {
+		p, err := promptPassphrase("Passphrase: ")
+		expect(err, "Failed to read passphrase")
+		c.secret = p
+	}
+	if len(c.secret) == 0 {
+		fmt.Fprintln(os.Stderr, "Refusing to use an empty passphrase")
+		os.Exit(1)
+	}
+	return c.secret
+}
+
+// Read a passphrase from the terminal with echoing disabled.  The
+// standard library has no portable way of doing this so we shell out
+// to stty(1) like everyone else.
+func promptPassphrase(prompt string) ([]byte, error) {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return nil, errors.New("stdin isn't a terminal; " +
+			"set AUDIBLE_DL_PASSPHRASE or AUDIBLE_DL_KEYFILE")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}
+	stty("-echo")
+	defer stty("echo")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// Encrypt PLAIN with a key derived from the client's passphrase.
+func (c *Client) seal(plain []byte) ([]byte, error) {
+	salt := make([]byte, secretSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newSecretCipher(c.passphrase(), salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte(secretMagic), salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plain, []byte(secretMagic)), nil
+}
+
+// Decrypt the output of seal() passed in SEALED.
+func (c *Client) unseal(sealed []byte) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, []byte(secretMagic)) {
+		return nil, errors.New("not an audible-dl encrypted file")
+	}
+	sealed = sealed[len(secretMagic):]
+	if len(sealed) < secretSaltLen {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	salt, sealed := sealed[:secretSaltLen], sealed[secretSaltLen:]
+	gcm, err := newSecretCipher(c.passphrase(), salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, sealed, []byte(secretMagic))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted file")
+	}
+	return plain, nil
+}
+
+// Read the file in PATH, transparently decrypting PATH.enc if the
+// plain-text version doesn't exist.  Errors satisfy os.IsNotExist()
+// when neither does.
+func (c *Client) readSecretFile(path string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err == nil || !os.IsNotExist(err) {
+		return raw, err
+	}
+	sealed, err := os.ReadFile(path + secretSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return c.unseal(sealed)
+}
+
+// Fill in the activation bytes of any account which doesn't specify
+// them in the config file, either by running its bytes_command or
+// from the encrypted store.
+func (c *Client) GetBytes() {
+	for i := 0; i < len(c.Accounts); i++ {
+		a := &c.Accounts[i]
+		if a.Bytes != "" {
+			continue
+		}
+		if a.BytesCommand != "" {
+			out, err := runSecretCommand(a.BytesCommand)
+			expect(err, "bytes_command failed for account "+a.Name)
+			a.Bytes = strings.TrimSpace(string(out))
+			continue
+		}
+		raw, err := c.readSecretFile(c.bytesPath(a.Name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		expect(err, "Failed to read activation bytes for "+a.Name)
+		a.Bytes = strings.TrimSpace(string(raw))
+	}
+}
+
+// Run the shell command CMD and return its standard output.  Stdin
+// and stderr are passed through so that tools like pass(1) can prompt
+// for a passphrase.
+func runSecretCommand(cmd string) ([]byte, error) {
+	sh := exec.Command("sh", "-c", cmd)
+	sh.Stdin = os.Stdin
+	sh.Stderr = os.Stderr
+	out, err := sh.Output()
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil, errors.New("command printed nothing: " + cmd)
+	}
+	return out, nil
+}
+
+// Encrypt every account's cookies and activation bytes, removing the
+// plain-text cookie files, including the backups left behind when
+// they were upgraded.  Bytes can't be removed from the config file
+// automatically, so we tell the user to do it.
+func (c *Client) LockSecrets() {
+	for _, a := range c.Accounts {
+		path := c.cookiesPath(a.Name)
+		if raw, err := os.ReadFile(path); err == nil {
+			c.writeSealed(path+secretSuffix, raw)
+			unwrap(os.Remove(path))
+			fmt.Printf("%s: encrypted %s\n", a.Name, path)
+		} else if !os.IsNotExist(err) {
+			unwrap(err)
+		}
+		// Sealed under the name they'd have had if the encrypted
+		// file had been upgraded, like foo.cookies.json.enc.v0
+		backups, err := filepath.Glob(path + ".v[0-9]*")
+		unwrap(err)
+		for _, backup := range backups {
+			raw, err := os.ReadFile(backup)
+			unwrap(err)
+			sealed := path + secretSuffix + strings.TrimPrefix(backup, path)
+			c.writeSealed(sealed, raw)
+			unwrap(os.Remove(backup))
+			fmt.Printf("%s: encrypted %s\n", a.Name, backup)
+		}
+		if a.Bytes != "" {
+			path = c.bytesPath(a.Name) + secretSuffix
+			c.writeSealed(path, []byte(a.Bytes))
+			fmt.Printf("%s: encrypted activation bytes into %s\n",
+				a.Name, path)
+			fmt.Printf("%s: you may now remove `bytes' from the "+
+				"config file\n", a.Name)
+		}
+	}
+}
+
+// Decrypt every account's cookies and activation bytes back into
+// plain-text files, which only the user can read.
+func (c *Client) UnlockSecrets() {
+	for _, a := range c.Accounts {
+		path := c.cookiesPath(a.Name)
+		if sealed, err := os.ReadFile(path + secretSuffix); err == nil {
+			plain, err := c.unseal(sealed)
+			expect(err, "Failed to decrypt "+path+secretSuffix)
+			unwrap(writeFileAtomic(path, plain, 0600))
+			unwrap(os.Remove(path + secretSuffix))
+			fmt.Printf("%s: decrypted %s\n", a.Name, path)
+		} else if !os.IsNotExist(err) {
+			unwrap(err)
+		}
+		path = c.bytesPath(a.Name)
+		if sealed, err := os.ReadFile(path + secretSuffix); err == nil {
+			plain, err := c.unseal(sealed)
+			expect(err, "Failed to decrypt "+path+secretSuffix)
+			unwrap(writeFileAtomic(path, plain, 0600))
+			unwrap(os.Remove(path + secretSuffix))
+			fmt.Printf("%s: decrypted activation bytes into %s\n",
+				a.Name, path)
+		} else if !os.IsNotExist(err) {
+			unwrap(err)
+		}
+	}
+}
+
+// Encrypt PLAIN into PATH.
+func (c *Client) writeSealed(path string, plain []byte) {
+	sealed, err := c.seal(plain)
+	unwrap(err)
+	unwrap(writeFileAtomic(path, sealed, 0600))
+}
+
+// Return an AES-256-GCM cipher keyed with PASS and SALT.
+func newSecretCipher(pass, salt []byte) (cipher.AEAD, error) {
+	key := pbkdf2(pass, salt, secretRounds, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PBKDF2 with HMAC-SHA256 per RFC 8018.  This lives in
+// golang.org/x/crypto, but it's short enough not to be worth the
+// extra dependency.
+func pbkdf2(pass, salt []byte, rounds, keylen int) []byte {
+	prf := hmac.New(sha256.New, pass)
+	var key []byte
+	for block := uint32(1); len(key) < keylen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < rounds; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keylen]
+}
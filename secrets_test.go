@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Every user's key depends on this, so it's pinned to the PBKDF2-SHA256
+// test vectors from RFC 7914.
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		pass, salt string
+		rounds     int
+		want       string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605" +
+			"f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645" +
+			"991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9" +
+			"641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb" +
+			"841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, tt := range tests {
+		got := pbkdf2([]byte(tt.pass), []byte(tt.salt), tt.rounds, 64)
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %x, want %s", tt.pass,
+				tt.salt, tt.rounds, got, tt.want)
+		}
+	}
+}
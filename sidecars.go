@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////
+//      _     _
+//  ___(_) __| | ___  ___ __ _ _ __ ___
+// / __| |/ _` |/ _ \/ __/ _` | '__/ __|
+// \__ \ | (_| |  __/ (_| (_| | |  \__ \
+// |___/_|\__,_|\___|\___\__,_|_|  |___/
+////////////////////////////////////////////////////////////////////////
+
+// Describes a metadata file written next to a book for the benefit of
+// media servers.  Dir is its name when the book has a directory to
+// itself, and Ext is appended to the name of the book's files
+// otherwise, see bookStem().
+type sidecar struct {
+	Name string
+	Dir  string
+	Ext  string
+	Make func(b *Book) ([]byte, error)
+}
+
+// Every kind of sidecar, in the order they're written.  An account's
+// sidecars field lists the names of those it wants.
+var sidecars = []sidecar{
+	{"audiobookshelf", "metadata.json", ".metadata.json", sidecarABS},
+	{"desc", "desc.txt", ".desc.txt", sidecarDesc},
+	{"reader", "reader.txt", ".reader.txt", sidecarReader},
+	{"opf", "metadata.opf", ".opf", sidecarOPF},
+	{"nfo", "album.nfo", ".nfo", sidecarNFO},
+}
+
+// Make sure every sidecar account A asks for exists.
+func (a *Account) validateSidecars() error {
+outer:
+	for _, name := range a.Sidecars {
+		for _, s := range sidecars {
+			if s.Name == name {
+				continue outer
+			}
+		}
+		return errors.New("unknown sidecar " + name)
+	}
+	return nil
+}
+
+// Return the path of the sidecar S of book B of account A under the
+// layout called LAYOUT.  Books with a directory of their own get the
+// names media servers look for; otherwise they're named after the
+// book.
+func (c *Client) sidecarPath(a *Account, b *Book, s sidecar, layout string) string {
+	if ownsDir(a, b, layout) {
+		return c.bookDir(a, b, layout) + s.Dir
+	}
+	return c.bookDir(a, b, layout) + bookStem(b, layout) + s.Ext
+}
+
+// Write the sidecars account A asks for with book B's metadata next to
+// the book as it was saved, LOC, replacing any which are already
+// there.  LOC differs from B when B's metadata has changed since, as
+// the layout may depend on it.
+func (c *Client) writeSidecars(a *Account, b, loc *Book) error {
+	for _, s := range sidecars {
+		wanted := false
+		for _, name := range a.Sidecars {
+			wanted = wanted || name == s.Name
+		}
+		if !wanted {
+			continue
+		}
+		path := c.sidecarPath(a, loc, s, loc.Layout)
+		raw, err := s.Make(b)
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(path, raw, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update the files recorded for book B of account A with the sidecars
+// written next to LOC, see writeSidecars(), and their checksums,
+// rewriting the manifests of B's directories.  Books which predate us
+// recording their files are left alone, since recording just their
+// sidecars would make everything else look like it belonged to no
+// book.
+func (c *Client) recordSidecars(a *Account, b, loc *Book) {
+	if len(b.Files) == 0 {
+		return
+	}
+	for _, s := range sidecars {
+		f, err := c.statBookFile(c.sidecarPath(a, loc, s, loc.Layout))
+		if err == nil {
+			b.setFile(f)
+		}
+	}
+	c.hashFiles(b)
+	c.Downloaded[b.Title] = *b
+	c.writeManifests(b)
+}
+
+// Return B's series formatted like "Series #3", or "" if it isn't part
+// of one.
+func seriesName(b *Book) string {
+	if b.Series == "" {
+		return ""
+	}
+	if b.SeriesIndex > 0 {
+		return fmt.Sprintf("%s #%d", b.Series, b.SeriesIndex)
+	}
+	return b.Series
+}
+
+// An audiobookshelf metadata.json, the same format it writes itself
+// when "store metadata with item" is enabled.
+func sidecarABS(b *Book) ([]byte, error) {
+	type chapter struct {
+		ID    int     `json:"id"`
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+		Title string  `json:"title"`
+	}
+	doc := struct {
+		Title       string    `json:"title"`
+		Authors     []string  `json:"authors"`
+		Narrators   []string  `json:"narrators"`
+		Series      []string  `json:"series"`
+		Description string    `json:"description"`
+		ASIN        string    `json:"asin"`
+		Chapters    []chapter `json:"chapters"`
+	}{
+		Title:       b.Title,
+		Authors:     append([]string{}, b.Authors...),
+		Narrators:   append([]string{}, b.Narrators...),
+		Series:      []string{},
+		Description: b.Summary,
+		ASIN:        b.Slug,
+		Chapters:    []chapter{},
+	}
+	if s := seriesName(b); s != "" {
+		doc.Series = append(doc.Series, s)
+	}
+	for i, ch := range b.Chapters {
+		doc.Chapters = append(doc.Chapters,
+			chapter{i, ch.Start, ch.End, ch.Title})
+	}
+	raw, err := json.MarshalIndent(doc, "", "  ")
+	return append(raw, '\n'), err
+}
+
+// The plain text description audiobookshelf reads from desc.txt.
+func sidecarDesc(b *Book) ([]byte, error) {
+	return []byte(b.Summary + "\n"), nil
+}
+
+// The narrators audiobookshelf reads from reader.txt.
+func sidecarReader(b *Book) ([]byte, error) {
+	return []byte(strings.Join(b.Narrators, ", ") + "\n"), nil
+}
+
+// A Calibre-style OPF package document, which audiobookshelf also
+// reads.
+func sidecarOPF(b *Book) ([]byte, error) {
+	type creator struct {
+		Role string `xml:"opf:role,attr"`
+		Name string `xml:",chardata"`
+	}
+	type identifier struct {
+		Scheme string `xml:"opf:scheme,attr"`
+		Value  string `xml:",chardata"`
+	}
+	type meta struct {
+		Name    string `xml:"name,attr"`
+		Content string `xml:"content,attr"`
+	}
+	type metadata struct {
+		DC          string     `xml:"xmlns:dc,attr"`
+		OPF         string     `xml:"xmlns:opf,attr"`
+		Title       string     `xml:"dc:title"`
+		Creators    []creator  `xml:"dc:creator"`
+		Description string     `xml:"dc:description,omitempty"`
+		Identifier  identifier `xml:"dc:identifier"`
+		Meta        []meta     `xml:"meta"`
+	}
+	doc := struct {
+		XMLName  xml.Name `xml:"package"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Version  string   `xml:"version,attr"`
+		Metadata metadata `xml:"metadata"`
+	}{
+		Xmlns:   "http://www.idpf.org/2007/opf",
+		Version: "2.0",
+		Metadata: metadata{
+			DC:          "http://purl.org/dc/elements/1.1/",
+			OPF:         "http://www.idpf.org/2007/opf",
+			Title:       b.Title,
+			Description: b.Summary,
+			Identifier:  identifier{"ASIN", b.Slug},
+		},
+	}
+	for _, a := range b.Authors {
+		doc.Metadata.Creators = append(doc.Metadata.Creators,
+			creator{"aut", a})
+	}
+	for _, n := range b.Narrators {
+		doc.Metadata.Creators = append(doc.Metadata.Creators,
+			creator{"nrt", n})
+	}
+	if b.Series != "" {
+		doc.Metadata.Meta = append(doc.Metadata.Meta,
+			meta{"calibre:series", b.Series})
+		if b.SeriesIndex > 0 {
+			doc.Metadata.Meta = append(doc.Metadata.Meta,
+				meta{"calibre:series_index",
+					fmt.Sprint(b.SeriesIndex)})
+		}
+	}
+	raw, err := xml.MarshalIndent(doc, "", "  ")
+	return append([]byte(xml.Header), append(raw, '\n')...), err
+}
+
+// A Kodi album .nfo, which Jellyfin also reads.
+func sidecarNFO(b *Book) ([]byte, error) {
+	doc := struct {
+		XMLName     xml.Name `xml:"album"`
+		Title       string   `xml:"title"`
+		Artists     []string `xml:"artist"`
+		AlbumArtist string   `xml:"albumartist,omitempty"`
+		Genre       string   `xml:"genre"`
+		Review      string   `xml:"review,omitempty"`
+		Narrators   []string `xml:"narrator"`
+		Series      string   `xml:"series,omitempty"`
+		ASIN        string   `xml:"asin"`
+	}{
+		Title:     b.Title,
+		Artists:   b.Authors,
+		Genre:     "Audiobook",
+		Review:    b.Summary,
+		Narrators: b.Narrators,
+		Series:    seriesName(b),
+		ASIN:      b.Slug,
+	}
+	if len(b.Authors) > 0 {
+		doc.AlbumArtist = b.Authors[0]
+	}
+	raw, err := xml.MarshalIndent(doc, "", "  ")
+	return append([]byte(xml.Header), append(raw, '\n')...), err
+}
+
+// The parts of a book's metadata that can change on Audible's end
+// after it's been downloaded.  The runtime isn't one of them since the
+// library shows the time remaining instead once a book's been started.
+type bookMetadata struct {
+	Series      string
+	SeriesIndex int
+	Summary     string
+	CoverURL    string
+	Authors     []string
+	Narrators   []string
+}
+
+func metadataOf(b *Book) bookMetadata {
+	return bookMetadata{b.Series, b.SeriesIndex, b.Summary, b.CoverURL,
+		b.Authors, b.Narrators}
+}
+
+// Update the already downloaded copy of the freshly scraped book B
+// with its metadata if it's changed, regenerating A's sidecars.
+func (c *Client) refreshMetadata(a *Account, b *Book) {
+	old := c.Downloaded[b.Title]
+	if reflect.DeepEqual(metadataOf(&old), metadataOf(b)) {
+		return
+	}
+	loc := old
+	a.Log("Metadata for %s has changed", b.Title)
+	old.Series, old.SeriesIndex = b.Series, b.SeriesIndex
+	old.Summary, old.CoverURL = b.Summary, b.CoverURL
+	old.Authors, old.Narrators = b.Authors, b.Narrators
+	if err := c.writeSidecars(a, &old, &loc); err != nil {
+		log.Printf("Failed to update sidecars for %s: %s", b.Title, err)
+	}
+	c.recordSidecars(a, &old, &loc)
+	c.Downloaded[b.Title] = old
+	c.SetDownloaded()
+}
+
+// Implement the sidecars subcommand, which writes the sidecars for
+// every downloaded book belonging to ACCOUNT, or to any account if
+// it's empty, for when they've just been enabled.
+func (c *Client) SidecarsCommand(account string) {
+	n := 0
+	for _, b := range c.Downloaded {
+		a, err := c.bookAccount(&b, account)
+		if err != nil {
+			log.Printf("Skipping %s: %s", b.Title, err)
+			continue
+		}
+		if account != "" && a.Name != account {
+			continue
+		}
+		if err = c.writeSidecars(a, &b, &b); err != nil {
+			log.Printf("Failed to write sidecars for %s: %s",
+				b.Title, err)
+			continue
+		}
+		c.recordSidecars(a, &b, &b)
+		c.Downloaded[b.Title] = b
+		n++
+	}
+	c.SetDownloaded()
+	fmt.Printf("Wrote sidecars for %d books\n", n)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////
+//      _        _
+//  ___| |_ __ _| |_ ___
+// / __| __/ _` | __/ _ \
+// \__ \ || (_| | ||  __/
+// |___/\__\__,_|\__\___|
+////////////////////////////////////////////////////////////////////////
+
+// How many previous versions of the downloaded and failed book stores
+// are kept, as FILE.1 (the newest) to FILE.3.
+const stateBackups int = 3
+
+// Only one instance may use a DataDir at a time.  It holds a lock on
+// this file in DataDir, which contains its pid, while it runs.
+const lockFileName string = "audible-dl.lock"
+
+// Returned by lockFile() when another process holds the lock.
+var errLocked = errors.New("locked")
+
+// The lock file we hold, if any.  The lock belongs to the open file,
+// so it's kept here for the life of the process, and released by the
+// system however we exit.
+var heldLock *os.File
+
+// Write DATA to PATH so that a crash leaves either the old or the new
+// contents, never a mix: it's written to a temporary file in the same
+// directory, synced, and renamed over PATH.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Make sure the rename itself survives a crash
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Write DATA to the book store in PATH atomically, first moving its
+// old contents into the newest of its backups the first time it's
+// written in a run, so the backups are of previous runs rather than
+// previous books.
+func (c *Client) writeStore(path string, data []byte) error {
+	if c.rotated == nil {
+		c.rotated = make(map[string]bool)
+	}
+	if !c.rotated[path] {
+		if err := rotateBackups(path); err != nil {
+			return err
+		}
+		c.rotated[path] = true
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// Shift the backups of PATH along, dropping the oldest, and copy PATH
+// into the newest.
+func rotateBackups(path string) error {
+	old, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for i := stateBackups - 1; i > 0; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", path, i),
+			fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return writeFileAtomic(path+".1", old, 0644)
+}
+
+// Take the lock on DataDir, exiting with an explanation if another
+// instance holds it.  The file itself is never removed: another
+// instance may have it open, and removing it would let a third lock a
+// new file alongside it.
+func (c *Client) Lock() {
+	path := c.DataDir + lockFileName
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = lockFile(f); err == errLocked {
+		raw, _ := io.ReadAll(f)
+		log.Fatalf("Another audible-dl (pid %s) is already using %s, "+
+			"wait for it to finish", strings.TrimSpace(string(raw)),
+			c.DataDir)
+	} else if err != nil {
+		log.Fatalf("Failed to lock %s: %s", path, err)
+	}
+	// The pid is only there to help whoever finds the lock taken
+	if err = f.Truncate(0); err == nil {
+		_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	heldLock = f
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////
+//                _  __
+// __   _____ _ __(_)/ _|_   _
+// \ \ / / _ \ '__| | |_| | | |
+//  \ V /  __/ |  | |  _| |_| |
+//   \_/ \___|_|  |_|_|  \__, |
+//                       |___/
+////////////////////////////////////////////////////////////////////////
+
+// Converted books may be this many minutes shorter than the runtime
+// scraped from the library before they're considered truncated,
+// unless the config file says otherwise.  Audible rounds runtimes to
+// the minute.
+const defaultVerifyTolerance int = 3
+
+// Seconds of audio to decode at each end of a book when checking it.
+const verifyDecodeSeconds string = "60"
+
+// Matches the hours and minutes in runtimes like "5 hrs and 51 mins"
+// or "5h 51m left".
+var runtimeHoursRegexp = regexp.MustCompile(`(\d+)\s*h`)
+var runtimeMinutesRegexp = regexp.MustCompile(`(\d+)\s*m`)
+
+// Return the number of minutes a converted book may fall short of its
+// scraped runtime.
+func (c *Client) verifyTolerance() int {
+	if c.VerifyTolerance > 0 {
+		return c.VerifyTolerance
+	}
+	return defaultVerifyTolerance
+}
+
+// Return the runtime scraped from the library, like "5 hrs and 51
+// mins", in seconds, or 0 if it doesn't look like a runtime.
+func parseRuntime(runtime string) float64 {
+	var secs float64
+	if m := runtimeHoursRegexp.FindStringSubmatch(runtime); m != nil {
+		h, _ := strconv.Atoi(m[1])
+		secs += float64(h) * 3600
+	}
+	if m := runtimeMinutesRegexp.FindStringSubmatch(runtime); m != nil {
+		min, _ := strconv.Atoi(m[1])
+		secs += float64(min) * 60
+	}
+	return secs
+}
+
+// Check that the converted book B in M4B is complete: it must be no
+// shorter than the runtime scraped from the library, and its first
+// and last minute must decode without errors.  The library shows the
+// time remaining rather than the runtime for books that have been
+// started, so we can only catch books that are too short.
+func (c *Client) verifyBook(b *Book, m4b string) error {
+	duration, err := probeDuration(m4b)
+	if err != nil {
+		return fmt.Errorf("Failed to read the duration of %s: %s",
+			b.FileName, err)
+	}
+	if want := parseRuntime(b.Runtime); want > 0 {
+		short := want - duration
+		if short > float64(c.verifyTolerance()*60) {
+			return fmt.Errorf("Book is %.0f minutes shorter than "+
+				"its runtime of %s", short/60, b.Runtime)
+		}
+	}
+	if err = decodeCheck(m4b, "-t", verifyDecodeSeconds); err != nil {
+		return fmt.Errorf("Start doesn't decode: %s", err)
+	}
+	if err = decodeCheck(m4b, "-sseof", "-"+verifyDecodeSeconds); err != nil {
+		return fmt.Errorf("End doesn't decode: %s", err)
+	}
+	return nil
+}
+
+// Decode the audio in PATH, selecting which part with the ffmpeg input
+// options in SEEK, and fail if ffmpeg complains about anything.
+func decodeCheck(path string, seek ...string) error {
+	args := append([]string{"-v", "error", "-nostdin"}, seek...)
+	args = append(args, "-i", path, "-map", "0:a", "-f", "null", "-")
+	out, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		return err
+	}
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return fmt.Errorf("%s", strings.SplitN(msg, "\n", 2)[0])
+	}
+	return nil
+}
+
+// What VerifyCommand found wrong with a single file.  Book is the
+// title of the book it belongs to, if any, NewPath is where a moved
+// file was found, and Since is when a corrupt file was first found, if
+// it wasn't this time.
+type fileProblem struct {
+	Kind    string
+	Book    string
+	File    BookFile
+	NewPath string
+	Size    int64
+	Since   time.Time
+}
+
+// The kinds of fileProblem.
+const (
+	FileMissing  = "missing"
+	FileMoved    = "moved"
+	FileModified = "modified"
+	FileOrphaned = "orphaned"
+	FileCorrupt  = "corrupt"
+)
+
+// Implement the verify subcommand, which cross-checks the files
+// recorded for every downloaded book against what's actually in
+// SaveDir, reporting files which have gone missing, been moved, or
+// been modified, and files which don't belong to any book.  With
+// --checksums, the contents of the rest are checked too.  With
+// --repair, moved files are recorded where they were found, missing
+// sidecars are rewritten, and books missing or corrupting anything
+// else are downloaded again.
+func (c *Client) VerifyCommand(account string, argv []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "")
+	checksums := flags.Bool("checksums", false, "")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: audible-dl verify [--checksums] "+
+			"[--repair]\n")
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	problems := c.reconcile()
+	if *checksums {
+		skip := make(map[string]bool)
+		for _, p := range problems {
+			skip[p.File.Path] = true
+		}
+		problems = append(problems, c.checkSums(skip)...)
+		sort.Slice(problems, func(i, j int) bool {
+			return problems[i].File.Path < problems[j].File.Path
+		})
+	}
+	for _, p := range problems {
+		switch p.Kind {
+		case FileCorrupt:
+			since := "new since the last check"
+			if !p.Since.IsZero() {
+				since = "since " + p.Since.Format("2006-01-02")
+			}
+			fmt.Printf("%-9s %s (%s)\n", p.Kind, p.File.Path, since)
+		case FileMoved:
+			fmt.Printf("%-9s %s -> %s\n", p.Kind, p.File.Path, p.NewPath)
+		case FileModified:
+			fmt.Printf("%-9s %s (%d bytes, was %d)\n", p.Kind,
+				p.File.Path, p.Size, p.File.Size)
+		default:
+			fmt.Printf("%-9s %s\n", p.Kind, p.File.Path)
+		}
+	}
+	if len(problems) == 0 {
+		fmt.Println("Every book is intact")
+		return
+	}
+	if !*repair {
+		os.Exit(1)
+	}
+	if PrintSummary(c.repair(account, problems)) {
+		os.Exit(1)
+	}
+}
+
+// Compare the files recorded in the downloaded book store with those
+// in SaveDir.  Files whose size has changed count as modified.  A
+// recorded file which isn't where it should be is
+// considered moved if a file with the same name and size which
+// doesn't belong to any book turns up elsewhere.
+func (c *Client) reconcile() []fileProblem {
+	var problems []fileProblem
+	unknown := make(map[string]int64)
+	filepath.WalkDir(c.SaveDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != c.SaveDir && strings.HasPrefix(d.Name(), ".") ||
+			path+"/" == c.DataDir || path+"/" == c.TempDir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == manifestName {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil && fi.Mode().IsRegular() {
+			unknown[c.relPath(path)] = fi.Size()
+		}
+		return nil
+	})
+
+	var missing []fileProblem
+	for title, b := range c.Downloaded {
+		files := c.bookFiles(&b, "")
+		if len(files) == 0 {
+			missing = append(missing, fileProblem{Kind: FileMissing,
+				Book: title, File: BookFile{Path: b.FileName}})
+		}
+		for _, f := range files {
+			if filepath.IsAbs(f.Path) {
+				// Imported from outside SaveDir
+				if fi, err := os.Stat(f.Path); err == nil {
+					unknown[f.Path] = fi.Size()
+				}
+			}
+			size, ok := unknown[f.Path]
+			if !ok {
+				missing = append(missing, fileProblem{
+					Kind: FileMissing, Book: title, File: f})
+				continue
+			}
+			delete(unknown, f.Path)
+			if f.Size != 0 && size != f.Size {
+				problems = append(problems, fileProblem{
+					Kind: FileModified, Book: title, File: f,
+					Size: size})
+			}
+		}
+	}
+
+	for _, p := range missing {
+		for path, size := range unknown {
+			if filepath.Base(path) == filepath.Base(p.File.Path) &&
+				size == p.File.Size {
+				p.Kind = FileMoved
+				p.NewPath = path
+				delete(unknown, path)
+				break
+			}
+		}
+		problems = append(problems, p)
+	}
+	for path, size := range unknown {
+		problems = append(problems, fileProblem{Kind: FileOrphaned,
+			File: BookFile{Path: path, Size: size}})
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].File.Path < problems[j].File.Path
+	})
+	return problems
+}
+
+// Fix what can be fixed of PROBLEMS for the books belonging to
+// ACCOUNT, or to any account if it's empty, returning what happened
+// to each book that had to be downloaded again.
+func (c *Client) repair(account string, problems []fileProblem) []BookResult {
+	redownload := make(map[string]bool)
+	residecar := make(map[string]bool)
+	for _, p := range problems {
+		b, ok := c.Downloaded[p.Book]
+		if !ok {
+			continue
+		}
+		a, err := c.bookAccount(&b, account)
+		if err != nil || account != "" && a.Name != account {
+			continue
+		}
+		switch p.Kind {
+		case FileMoved:
+			if len(b.Files) == 0 {
+				continue
+			}
+			for i := range b.Files {
+				if b.Files[i].Path == p.File.Path {
+					b.Files[i].Path = p.NewPath
+				}
+			}
+			c.Downloaded[p.Book] = b
+			c.SetDownloaded()
+			c.writeManifests(&b)
+			fmt.Printf("Recorded %s at %s\n", p.File.Path, p.NewPath)
+		case FileMissing, FileCorrupt:
+			if c.isSidecar(a, &b, p.File.Path) {
+				residecar[p.Book] = true
+			} else {
+				redownload[p.Book] = true
+			}
+		}
+	}
+
+	for title := range residecar {
+		if redownload[title] {
+			continue
+		}
+		b := c.Downloaded[title]
+		a, _ := c.bookAccount(&b, account)
+		if err := c.writeSidecars(a, &b, &b); err != nil {
+			log.Printf("Failed to rewrite sidecars for %s: %s",
+				title, err)
+			continue
+		}
+		c.recordSidecars(a, &b, &b)
+		c.Downloaded[title] = b
+		c.SetDownloaded()
+		fmt.Printf("Rewrote the sidecars for %s\n", title)
+	}
+
+	if len(redownload) == 0 {
+		return nil
+	}
+	c.GetCookies()
+	c.GetFailed()
+	var results []BookResult
+	for title := range redownload {
+		if c.ctx.Err() != nil {
+			break
+		}
+		b := c.Downloaded[title]
+		a, _ := c.bookAccount(&b, account)
+		r := c.processBook(a, &b)
+		c.recordResult(b, r)
+		results = append(results, r)
+	}
+	return results
+}
+
+// Whether PATH is where one of the sidecars of book B of account A
+// belongs.
+func (c *Client) isSidecar(a *Account, b *Book, path string) bool {
+	for _, s := range sidecars {
+		if path == c.relPath(c.sidecarPath(a, b, s, b.Layout)) {
+			return true
+		}
+	}
+	return false
+}